@@ -0,0 +1,586 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// clusterSlots is the number of hash slots keys are divided between.
+const clusterSlots = 16384
+
+// maxRedirects bounds the MOVED and ASK redirects followed for one command.
+const maxRedirects = 5
+
+var errNoPendingReplies = errors.New("No pending replies to receive")
+
+// HashTag wraps the queue name in braces so that Redis Cluster hashes only
+// the name, placing the queue and all of its processing, delayed,
+// dead-letter and priority keys in the same slot.  Queues used with a
+// cluster pool should be created with a hash-tagged key:
+//
+//	q := rq.QueueConnect(pool, rq.HashTag("jobs"))
+func HashTag(name string) string {
+	return "{" + name + "}"
+}
+
+// KeySlot returns the Redis Cluster hash slot of the key.  Only the part
+// between the first "{" and the following "}" is hashed when it is not
+// empty.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 computes the CRC16-CCITT (XMODEM) checksum used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc ^ uint16(s[i])<<8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+	}
+	return crc
+}
+
+// keylessCommands take no key, and are sent to any node unless the
+// connection is pinned to one.
+var keylessCommands = map[string]bool{
+	"ASKING": true, "AUTH": true, "CLIENT": true, "CLUSTER": true, "CONFIG": true,
+	"DBSIZE": true, "DISCARD": true, "ECHO": true, "EXEC": true, "FLUSHALL": true,
+	"FLUSHDB": true, "INFO": true, "MULTI": true, "PING": true, "READONLY": true,
+	"ROLE": true, "SCRIPT": true, "SELECT": true, "TIME": true, "UNWATCH": true,
+}
+
+// commandKey returns the key the command operates on, which decides the
+// node it is sent to.
+func commandKey(name string, args []interface{}) (string, bool) {
+	name = strings.ToUpper(name)
+	index := 0
+	switch {
+	case keylessCommands[name]:
+		return "", false
+	case name == "EVAL" || name == "EVALSHA":
+		if len(args) < 3 || fmt.Sprint(args[1]) == "0" {
+			return "", false
+		}
+		index = 2
+	}
+	if index >= len(args) {
+		return "", false
+	}
+
+	switch key := args[index].(type) {
+	case string:
+		return key, true
+	case []byte:
+		return string(key), true
+	default:
+		return fmt.Sprint(key), true
+	}
+}
+
+// cluster tracks which node serves each hash slot of a Redis Cluster.
+type cluster struct {
+	addrs   []string
+	options ConnectOptions
+
+	mu         sync.RWMutex
+	slots      [clusterSlots]string
+	loaded     bool
+	refreshing bool
+}
+
+// addr returns the address of the node serving the slot, or of any node
+// when the slot is negative or unassigned.
+func (cl *cluster) addr(slot int) string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	if slot >= 0 && cl.slots[slot] != "" {
+		return cl.slots[slot]
+	}
+	for _, addr := range cl.slots {
+		if addr != "" {
+			return addr
+		}
+	}
+	return cl.addrs[0]
+}
+
+// nodes returns the addresses of the known nodes, followed by the seeds.
+func (cl *cluster) nodes() []string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, addr := range append(cl.slots[:], cl.addrs...) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, addr)
+		}
+	}
+	return nodes
+}
+
+func (cl *cluster) dial(addr string) (redis.Conn, error) {
+	options := cl.options
+	options.Network, options.Address = "tcp", addr
+	return options.Dial()
+}
+
+// load reads the slot map unless it has already been read.
+func (cl *cluster) load() error {
+	cl.mu.RLock()
+	loaded := cl.loaded
+	cl.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	return cl.refresh()
+}
+
+// refresh reads the slot map from the first node that answers CLUSTER
+// SLOTS.
+func (cl *cluster) refresh() error {
+	err := errors.New("No cluster nodes configured")
+	for _, addr := range cl.nodes() {
+		var slots [clusterSlots]string
+		if slots, err = cl.readSlots(addr); err == nil {
+			cl.mu.Lock()
+			cl.slots, cl.loaded = slots, true
+			cl.mu.Unlock()
+			return nil
+		}
+	}
+	return err
+}
+
+// refreshInBackground rereads the slot map unless that is already under
+// way.
+func (cl *cluster) refreshInBackground() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.refreshing {
+		return
+	}
+	cl.refreshing = true
+	go func() {
+		cl.refresh()
+		cl.mu.Lock()
+		cl.refreshing = false
+		cl.mu.Unlock()
+	}()
+}
+
+func (cl *cluster) readSlots(addr string) (slots [clusterSlots]string, err error) {
+	c, err := cl.dial(addr)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return
+	}
+	for _, r := range ranges {
+		var fields, master []interface{}
+		var start, end, port int
+		var host string
+		if fields, err = redis.Values(r, nil); err != nil || len(fields) < 3 {
+			return slots, fmt.Errorf("Invalid CLUSTER SLOTS reply from %s", addr)
+		}
+		if start, err = redis.Int(fields[0], nil); err != nil {
+			return
+		}
+		if end, err = redis.Int(fields[1], nil); err != nil {
+			return
+		}
+		if master, err = redis.Values(fields[2], nil); err != nil || len(master) < 2 {
+			return slots, fmt.Errorf("Invalid CLUSTER SLOTS reply from %s", addr)
+		}
+		if host, err = redis.String(master[0], nil); err != nil {
+			return
+		}
+		if port, err = redis.Int(master[1], nil); err != nil {
+			return
+		}
+		if host == "" {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	return slots, nil
+}
+
+// moved records that the slot is now served by the node at addr, and
+// rereads the rest of the slot map in the background.
+func (cl *cluster) moved(slot int, addr string) {
+	cl.mu.Lock()
+	cl.slots[slot] = addr
+	cl.mu.Unlock()
+
+	cl.refreshInBackground()
+}
+
+// parseRedirect returns the slot and address of a MOVED or ASK error reply.
+func parseRedirect(reply interface{}) (kind string, slot int, addr string, ok bool) {
+	err, isError := reply.(redis.Error)
+	if !isError {
+		return
+	}
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return
+	}
+	if slot, err := strconv.Atoi(fields[1]); err == nil {
+		return fields[0], slot, fields[2], true
+	}
+	return
+}
+
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+// clusterConn is a connection to every node of a cluster that it has sent a
+// command to.  Each command goes to the node serving its key, following
+// redirects.  A pipeline goes to the node serving its first key, so its keys
+// should share a slot, as a hash-tagged queue's do.  WATCH pins the
+// connection to the node until the transaction ends, as do pipelined
+// commands until their replies are received.  A connection pinned after an
+// ASK redirect sends ASKING before each command.
+type clusterConn struct {
+	cluster *cluster
+	conns   map[string]redis.Conn
+
+	queued   []clusterCommand
+	pinned   string
+	asking   bool
+	pending  int
+	watching bool
+
+	// ctx, if set, is the context a command is being run under by
+	// doContext.
+	ctx context.Context
+}
+
+func (c *clusterConn) Close() (err error) {
+	for addr, conn := range c.conns {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(c.conns, addr)
+	}
+	return
+}
+
+// Err returns the error of any node connection that is no longer usable.
+func (c *clusterConn) Err() error {
+	for _, conn := range c.conns {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	c.queued = append(c.queued, clusterCommand{cmd, args})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	commands := c.queued
+	c.queued = nil
+	if len(commands) == 0 {
+		return nil
+	}
+
+	addr := c.pinned
+	if addr == "" {
+		addr = c.cluster.addr(commandsSlot(commands))
+	}
+	conn, err := c.node(addr)
+	if err != nil {
+		return err
+	}
+	for _, command := range commands {
+		conn.Send(command.name, command.args...)
+	}
+	c.pinned = addr
+	c.pending = c.pending + len(commands)
+	c.track(commands)
+	return conn.Flush()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if len(c.queued) > 0 {
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if c.pending == 0 {
+		return nil, errNoPendingReplies
+	}
+
+	reply, err := c.conns[c.pinned].Receive()
+	c.pending--
+	if _, slot, addr, ok := parseRedirect(err); ok {
+		c.cluster.moved(slot, addr)
+	}
+	c.unpin()
+	return reply, err
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if isConnProbe(cmd, args) {
+		return c, nil
+	}
+
+	commands := c.queued
+	if cmd != "" {
+		commands = append(commands, clusterCommand{cmd, args})
+	}
+	c.queued = nil
+	if len(commands) == 0 && c.pending == 0 {
+		return nil, nil
+	}
+
+	replies, err := c.run(commands)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == "" {
+		return replies, nil
+	}
+	// like redis.Conn, return the last reply along with the first error
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok && err == nil {
+			err = e
+		}
+	}
+	return replies[len(replies)-1], err
+}
+
+// doContext runs the command, interrupting it on the node it was sent to if
+// the context is done before the reply arrives.
+func (c *clusterConn) doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	c.ctx = ctx
+	defer func() { c.ctx = nil }()
+
+	return c.Do(cmd, args...)
+}
+
+// run sends the commands to the node serving them and returns every pending
+// reply.  Redirects are followed unless the connection is pinned, and a
+// failed node is replaced by rereading the slot map.
+func (c *clusterConn) run(commands []clusterCommand) ([]interface{}, error) {
+	if c.pinned != "" {
+		replies, err := c.exec(c.pinned, c.asking, commands)
+		if err == nil {
+			c.track(commands)
+			c.unpin()
+		}
+		return replies, err
+	}
+
+	slot := commandsSlot(commands)
+	addr := c.cluster.addr(slot)
+	asking := false
+	for redirects := 0; ; redirects++ {
+		replies, err := c.exec(addr, asking, commands)
+		if err != nil {
+			if redirects == maxRedirects || err == context.Canceled || err == context.DeadlineExceeded {
+				return nil, err
+			}
+			c.drop(addr)
+			if c.cluster.refresh() != nil || c.cluster.addr(slot) == addr {
+				return nil, err
+			}
+			addr, asking = c.cluster.addr(slot), false
+			continue
+		}
+
+		kind, movedSlot, target, redirected := firstRedirect(replies)
+		if !redirected || redirects == maxRedirects {
+			c.pinned, c.asking = addr, asking
+			c.track(commands)
+			c.unpin()
+			return replies, nil
+		}
+		if kind == "MOVED" {
+			c.cluster.moved(movedSlot, target)
+		}
+		addr, asking = target, kind == "ASK"
+	}
+}
+
+// exec sends the commands to the node at addr, each preceded by ASKING when
+// following an ASK redirect, and returns the replies to every command sent
+// to the node since replies were last read, other than those to ASKING.
+func (c *clusterConn) exec(addr string, asking bool, commands []clusterCommand) ([]interface{}, error) {
+	conn, err := c.node(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make([]bool, c.pending, c.pending+2*len(commands))
+	for i := range keep {
+		keep[i] = true
+	}
+	inMulti := false
+	for _, command := range commands {
+		if asking && !inMulti {
+			conn.Send("ASKING")
+			keep = append(keep, false)
+		}
+		conn.Send(command.name, command.args...)
+		keep = append(keep, true)
+		switch strings.ToUpper(command.name) {
+		case "MULTI":
+			inMulti = true
+		case "EXEC", "DISCARD":
+			inMulti = false
+		}
+	}
+	c.pending = 0
+
+	var all []interface{}
+	if cc, ok := conn.(contextConn); ok && c.ctx != nil {
+		all, err = redis.Values(cc.doContext(c.ctx, ""))
+	} else {
+		all, err = redis.Values(conn.Do(""))
+	}
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, 0, len(all))
+	for i, reply := range all {
+		if i >= len(keep) || keep[i] {
+			replies = append(replies, reply)
+		}
+	}
+	return replies, nil
+}
+
+// node returns the connection to the node at addr, dialing it if needed.
+func (c *clusterConn) node(addr string) (redis.Conn, error) {
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := c.cluster.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// drop closes and forgets the connection to the node at addr.
+func (c *clusterConn) drop(addr string) {
+	if conn, ok := c.conns[addr]; ok {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+// track follows WATCH and the commands ending a transaction.
+func (c *clusterConn) track(commands []clusterCommand) {
+	for _, command := range commands {
+		switch strings.ToUpper(command.name) {
+		case "WATCH":
+			c.watching = true
+		case "EXEC", "DISCARD", "UNWATCH":
+			c.watching = false
+		}
+	}
+}
+
+// unpin releases the connection from its node once no transaction or
+// pipeline needs it.
+func (c *clusterConn) unpin() {
+	if !c.watching && c.pending == 0 {
+		c.pinned, c.asking = "", false
+	}
+}
+
+// commandsSlot returns the slot of the first command with a key, or -1 if
+// none has one.
+func commandsSlot(commands []clusterCommand) int {
+	for _, command := range commands {
+		if key, ok := commandKey(command.name, command.args); ok {
+			return KeySlot(key)
+		}
+	}
+	return -1
+}
+
+// firstRedirect returns the first MOVED or ASK error among the replies.
+func firstRedirect(replies []interface{}) (kind string, slot int, addr string, ok bool) {
+	for _, reply := range replies {
+		if kind, slot, addr, ok = parseRedirect(reply); ok {
+			return
+		}
+	}
+	return
+}
+
+// NewClusterPool creates a pool of connections to a Redis Cluster, reading
+// the slot map from the first of the seed addresses that answers.  Commands
+// are sent to the node serving their key, following MOVED and ASK redirects,
+// so the pool can be used wherever a single server's pool is.  The options
+// are used for every node, other than the address; the Database must be
+// zero.  Queues should be given hash-tagged keys, see HashTag.
+func NewClusterPool(addrs []string, options *ConnectOptions, maxIdle int, maxActive int, idleTime time.Duration) *redis.Pool {
+	cl := &cluster{addrs: addrs, options: *options}
+
+	pool := NewPoolWithOptions(options, maxIdle, maxActive, idleTime)
+	pool.Dial = func() (redis.Conn, error) {
+		if len(addrs) == 0 {
+			return nil, errors.New("No cluster nodes configured")
+		}
+		if err := cl.load(); err != nil {
+			return nil, err
+		}
+		return &clusterConn{cluster: cl, conns: make(map[string]redis.Conn)}, nil
+	}
+	return pool
+}
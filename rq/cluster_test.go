@@ -0,0 +1,299 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/skidder/redis-queue/rqtest"
+)
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 0x31C3},
+		{"foo", 12182},
+		{"{foo}:processing:worker", 12182},
+		{"bar{foo}{baz}", 12182},
+	}
+	for _, test := range tests {
+		if slot := KeySlot(test.key); slot != test.slot {
+			t.Error("Expected slot ", test.slot, " for ", test.key, " but got: ", slot)
+		}
+	}
+	if KeySlot("{}foo") == KeySlot("") || KeySlot("foo{{bar}}") != KeySlot("{bar") {
+		t.Error("Expected empty and nested hash tags to follow Redis")
+	}
+}
+
+func TestHashTagKeysShareSlot(t *testing.T) {
+	q := QueueConnect(nil, HashTag("jobs"))
+	pq := NewPriorityQueue(nil, HashTag("jobs"), 3)
+	slot := KeySlot(q.key)
+	for _, key := range []string{
+		q.processingKey("worker"),
+		deadlinesKey(q.processingKey("worker")),
+		q.consumersKey(),
+		q.attemptsKey(),
+		q.errorsKey(),
+		q.delayedKey(),
+		q.deadKey(),
+		pq.levelKey(2),
+	} {
+		if KeySlot(key) != slot {
+			t.Error("Expected the key to share the queue's slot: ", key)
+		}
+	}
+}
+
+// testCluster simulates a Redis Cluster of nodes that each serve the slots
+// assigned to them from a shared server, and redirect commands for other
+// slots.
+type testCluster struct {
+	server *rqtest.Server
+	nodes  []*stubServer
+	served []int32
+
+	mu        sync.Mutex
+	owner     [clusterSlots]int
+	importing map[int]int
+	backends  []redis.Conn
+}
+
+func newTestCluster(t *testing.T, nodes int) *testCluster {
+	tc := &testCluster{server: startServer(t), served: make([]int32, nodes), importing: make(map[int]int)}
+	for slot := range tc.owner {
+		tc.owner[slot] = slot * nodes / clusterSlots
+	}
+	for i := 0; i < nodes; i++ {
+		i := i
+		tc.nodes = append(tc.nodes, newSessionStubServer(t, func() func(args []string) interface{} {
+			return tc.session(i)
+		}))
+	}
+	t.Cleanup(func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		for _, backend := range tc.backends {
+			backend.Close()
+		}
+	})
+	return tc
+}
+
+// session returns the handler of a connection to node i.
+func (tc *testCluster) session(i int) func(args []string) interface{} {
+	backend, err := redis.Dial("tcp", tc.server.Addr())
+	tc.mu.Lock()
+	tc.backends = append(tc.backends, backend)
+	tc.mu.Unlock()
+
+	asking, inMulti := false, false
+	return func(args []string) interface{} {
+		if err != nil {
+			return err
+		}
+		name := strings.ToUpper(args[0])
+		values := make([]interface{}, len(args)-1)
+		for j, arg := range args[1:] {
+			values[j] = arg
+		}
+
+		switch name {
+		case "CLUSTER":
+			return tc.slotsReply()
+		case "ASKING":
+			asking = true
+			return "OK"
+		case "MULTI":
+			inMulti = true
+		case "EXEC", "DISCARD":
+			inMulti = false
+		}
+		if key, ok := commandKey(name, values); ok {
+			if redirect := tc.redirect(i, KeySlot(key), asking); redirect != nil {
+				return redirect
+			}
+			atomic.AddInt32(&tc.served[i], 1)
+		}
+		if !inMulti && name != "MULTI" {
+			asking = false
+		}
+
+		reply, err := backend.Do(name, values...)
+		if err != nil {
+			return err
+		}
+		return reply
+	}
+}
+
+// redirect returns the error redirecting a command for the slot away from
+// node i, if it should not serve it.
+func (tc *testCluster) redirect(i int, slot int, asking bool) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	target, migrating := tc.importing[slot]
+	switch {
+	case tc.owner[slot] == i && migrating:
+		return redis.Error(fmt.Sprintf("ASK %d %s", slot, tc.nodes[target].addr()))
+	case tc.owner[slot] != i && !(asking && migrating && target == i):
+		return redis.Error(fmt.Sprintf("MOVED %d %s", slot, tc.nodes[tc.owner[slot]].addr()))
+	}
+	return nil
+}
+
+func (tc *testCluster) slotsReply() []interface{} {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	var reply []interface{}
+	for start := 0; start < clusterSlots; {
+		end := start
+		for end+1 < clusterSlots && tc.owner[end+1] == tc.owner[start] {
+			end++
+		}
+		host, port, _ := net.SplitHostPort(tc.nodes[tc.owner[start]].addr())
+		var portNumber int64
+		fmt.Sscan(port, &portNumber)
+		reply = append(reply, []interface{}{int64(start), int64(end), []interface{}{host, portNumber, "node"}})
+		start = end + 1
+	}
+	return reply
+}
+
+// queueOnNode returns a hash-tagged queue name whose slot is served by node
+// i.
+func (tc *testCluster) queueOnNode(i int) string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for n := 0; ; n++ {
+		name := HashTag(fmt.Sprintf("rq_test_cluster_%d", n))
+		if tc.owner[KeySlot(name)] == i {
+			return name
+		}
+	}
+}
+
+func (tc *testCluster) servedBy(i int) int32 {
+	return atomic.LoadInt32(&tc.served[i])
+}
+
+func TestClusterPoolRoutesKeys(t *testing.T) {
+	tc := newTestCluster(t, 2)
+	pool := NewClusterPool([]string{"127.0.0.1:1", tc.nodes[1].addr()}, &ConnectOptions{}, 1, 1, 240*time.Second)
+	defer pool.Close()
+
+	for i := range tc.nodes {
+		name := tc.queueOnNode(i)
+		q := QueueConnect(pool, name)
+		before := tc.servedBy(i)
+
+		if err := q.PushBatch([]string{"foo", "bar", "baz"}); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		d, err := q.ReliablePop("worker", 1)
+		if err != nil || d.Value != "foo" || d.Attempts != 1 {
+			t.Fatal("Unexpected delivery: ", d, err)
+		}
+		if err = d.Nack(true); err != nil {
+			t.Error("Unexpected error: ", err)
+		}
+		if values, err := q.PopBatch(3, 1); len(values) != 3 || err != nil {
+			t.Error("Expected three values but got: ", values, err)
+		}
+
+		if tc.servedBy(i) == before {
+			t.Error("Expected node ", i, " to serve its queue")
+		}
+	}
+}
+
+func TestClusterPoolFollowsMoved(t *testing.T) {
+	tc := newTestCluster(t, 2)
+	pool := NewClusterPool([]string{tc.nodes[0].addr()}, &ConnectOptions{}, 1, 1, 240*time.Second)
+	defer pool.Close()
+
+	name := tc.queueOnNode(0)
+	q := QueueConnect(pool, name)
+	q.Push("foo")
+
+	tc.mu.Lock()
+	tc.owner[KeySlot(name)] = 1
+	tc.mu.Unlock()
+
+	before := tc.servedBy(1)
+	if value, err := q.Pop(1); value != "foo" || err != nil {
+		t.Error("Expected foo but got: ", value, err)
+	}
+	if tc.servedBy(1) == before {
+		t.Error("Expected the pop to be redirected to the new owner")
+	}
+}
+
+func TestClusterPoolFollowsAsk(t *testing.T) {
+	tc := newTestCluster(t, 2)
+	pool := NewClusterPool([]string{tc.nodes[0].addr()}, &ConnectOptions{}, 1, 1, 240*time.Second)
+	defer pool.Close()
+
+	name := tc.queueOnNode(0)
+	q := QueueConnect(pool, name)
+
+	tc.mu.Lock()
+	tc.importing[KeySlot(name)] = 1
+	tc.mu.Unlock()
+
+	q.Push("foo")
+	d, err := q.ReliablePop("worker", 1)
+	if err != nil || d.Value != "foo" || d.Attempts != 1 {
+		t.Fatal("Unexpected delivery: ", d, err)
+	}
+	if err = d.Ack(); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if tc.servedBy(0) != 0 {
+		t.Error("Expected the migrating node to serve nothing, served: ", tc.servedBy(0))
+	}
+}
+
+func TestClusterPoolPopContextCancel(t *testing.T) {
+	tc := newTestCluster(t, 2)
+	pool := NewClusterPool([]string{tc.nodes[0].addr()}, &ConnectOptions{}, 1, 1, 240*time.Second)
+	defer pool.Close()
+	q := QueueConnect(pool, tc.queueOnNode(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := q.PopContext(ctx, 0); err != context.Canceled {
+		t.Error("Expected context canceled error, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected cancellation to interrupt the pop, took: ", elapsed)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Codec converts values to and from the strings stored on a queue.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes values with encoding/gob.  Each message carries its own
+// type information, so messages can be decoded independently.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// MarshalerCodec encodes values that marshal themselves, such as generated
+// protocol buffer messages, through their Marshal and Unmarshal methods.
+// Nil message pointers are allocated before unmarshaling.
+type MarshalerCodec struct{}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type unmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+func (MarshalerCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(marshaler)
+	if !ok {
+		return nil, fmt.Errorf("Type %T does not implement Marshal", v)
+	}
+	return m.Marshal()
+}
+
+func (MarshalerCodec) Unmarshal(data []byte, v interface{}) error {
+	if u, ok := v.(unmarshaler); ok {
+		return u.Unmarshal(data)
+	}
+
+	// v is commonly a pointer to a nil message pointer
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if u, ok := rv.Elem().Interface().(unmarshaler); ok {
+			return u.Unmarshal(data)
+		}
+	}
+	return fmt.Errorf("Type %T does not implement Unmarshal", v)
+}
+
+// DecodeError is returned when a popped message cannot be decoded by a
+// codec.  The message has already been removed from the queue.
+type DecodeError struct {
+	Message string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to decode message: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type doResult struct {
+	reply interface{}
+	err   error
+}
+
+// doContext runs a command on a pooled connection, returning the context's
+// error if it is done before the reply arrives.  The command may still be
+// applied in that case; the connection is returned to the pool once it
+// completes.
+func doContext(ctx context.Context, pool *redis.Pool, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		c := pool.Get()
+		defer c.Close()
+
+		return c.Do(cmd, args...)
+	}
+
+	done := make(chan doResult, 1)
+	go func() {
+		c := pool.Get()
+		defer c.Close()
+
+		reply, err := c.Do(cmd, args...)
+		done <- doResult{reply, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// contextConn is implemented by the connections dialed by this package,
+// which can bound a command by a context.
+type contextConn interface {
+	doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+}
+
+// connProbe is echoed to find the connection beneath a pooled connection.
+// Connections dialed by this package answer it with themselves, without a
+// round trip to the server.
+const connProbe = "\x00rq:conn"
+
+func isConnProbe(cmd string, args []interface{}) bool {
+	if len(args) != 1 || !strings.EqualFold(cmd, "ECHO") {
+		return false
+	}
+	probe, ok := args[0].(string)
+	return ok && probe == connProbe
+}
+
+// contextConnOf returns the connection beneath a pooled connection if it
+// can bound a command by a context.
+func contextConnOf(c redis.Conn) (contextConn, bool) {
+	reply, _ := c.Do("ECHO", connProbe)
+	cc, ok := reply.(contextConn)
+	return cc, ok
+}
+
+// blockingDoContext runs a blocking command such as BRPOP, appending the
+// timeout in seconds to its arguments, on a pooled connection.  When the
+// context can be cancelled and the connection was dialed by this package,
+// the read is bounded by the context's deadline and the connection is
+// closed to interrupt the command if the context is done first; the pool
+// then discards it.  On other connections the command is issued repeatedly
+// with a timeout of at most popSweepWait seconds, and the context is checked
+// in between.  A reply that arrives before the command is interrupted is
+// still returned, so a popped message is never dropped.
+func blockingDoContext(ctx context.Context, pool *redis.Pool, timeout int, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c := pool.Get()
+	defer c.Close()
+
+	if ctx.Done() == nil {
+		return c.Do(cmd, append(args, timeout)...)
+	}
+	if cc, ok := contextConnOf(c); ok {
+		return cc.doContext(ctx, cmd, append(args, timeout)...)
+	}
+	for remaining := timeout; ; {
+		wait := popSweepWait
+		if timeout > 0 && remaining < wait {
+			wait = remaining
+		}
+		reply, err := c.Do(cmd, append(args, wait)...)
+		if err != nil || reply != nil {
+			return reply, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			if remaining = remaining - wait; remaining <= 0 {
+				return nil, redis.ErrNil
+			}
+		}
+	}
+}
+
+// contextTimeout bounds a blocking command timeout, in seconds, by the
+// context's deadline so the server gives up waiting no later than the
+// caller.  A timeout of zero blocks indefinitely.
+func contextTimeout(ctx context.Context, timeout int) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+
+	remaining := int(math.Ceil(time.Until(deadline).Seconds()))
+	if remaining < 1 {
+		remaining = 1
+	}
+	if timeout == 0 || remaining < timeout {
+		return remaining
+	}
+	return timeout
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Reasons recorded on a DeadLetter.
+const (
+	// DeadReasonNacked is recorded when the final delivery was nacked.
+	DeadReasonNacked = "nacked"
+	// DeadReasonExpired is recorded when the final delivery was not
+	// acknowledged within the visibility timeout.
+	DeadReasonExpired = "expired"
+)
+
+// DeadLetter is a message that was moved to a queue's dead-letter list after
+// using up its delivery attempts.
+type DeadLetter struct {
+	Value    string    `json:"value"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetters returns the messages on the queue's dead-letter list between
+// the start and stop indexes, most recently failed first.  Indexes follow
+// the LRANGE convention, so DeadLetters(0, -1) returns the whole list.
+func (queue *Queue) DeadLetters(start int, stop int) ([]DeadLetter, error) {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	entries, err := redis.Strings(c.Do("LRANGE", queue.deadKey(), start, stop))
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, len(entries))
+	for i, entry := range entries {
+		if err = json.Unmarshal([]byte(entry), &letters[i]); err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// DeadLength will return the number of messages on the queue's dead-letter
+// list.
+func (queue *Queue) DeadLength() (int, error) {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	return redis.Int(c.Do("LLEN", queue.deadKey()))
+}
+
+// ReplayDead moves up to max of the oldest messages on the dead-letter list
+// back onto the queue with a fresh set of delivery attempts, and returns the
+// number of messages moved.
+func (queue *Queue) ReplayDead(max int) (replayed int, err error) {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	if max <= 0 {
+		return
+	}
+
+	deadKey := queue.deadKey()
+	for {
+		if _, err = c.Do("WATCH", deadKey); err != nil {
+			return
+		}
+
+		var entries []string
+		if entries, err = redis.Strings(c.Do("LRANGE", deadKey, -max, -1)); err != nil {
+			return
+		}
+		if len(entries) == 0 {
+			c.Do("UNWATCH")
+			return
+		}
+
+		c.Send("MULTI")
+		for i := len(entries) - 1; i >= 0; i-- {
+			var letter DeadLetter
+			if err = json.Unmarshal([]byte(entries[i]), &letter); err != nil {
+				c.Do("DISCARD")
+				return
+			}
+			c.Send("RPOP", deadKey)
+			c.Send("LPUSH", queue.key, letter.Value)
+		}
+		var reply interface{}
+		if reply, err = c.Do("EXEC"); err != nil {
+			return
+		}
+		if reply != nil {
+			return len(entries), nil
+		}
+		// the dead-letter list changed while it was being watched, try again
+	}
+}
+
+func (queue *Queue) deadKey() string {
+	return queue.key + ":dead"
+}
+
+// exhausted reports whether a message delivered the given number of times
+// has used up its delivery attempts.
+func (queue *Queue) exhausted(attempts int) bool {
+	return queue.MaxAttempts > 0 && attempts >= queue.MaxAttempts
+}
+
+// sendDeadLetter queues the commands that move a value to the dead-letter
+// list and forget its delivery history.  It is used within a transaction.
+func (queue *Queue) sendDeadLetter(c redis.Conn, value string, reason string, lastError string, attempts int) {
+	entry, _ := json.Marshal(DeadLetter{
+		Value:    value,
+		Reason:   reason,
+		Error:    lastError,
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	})
+	c.Send("LPUSH", queue.deadKey(), entry)
+	c.Send("HDEL", queue.attemptsKey(), historyField(value))
+	c.Send("HDEL", queue.errorsKey(), historyField(value))
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func resetDeadLetterQueue(q *Queue, consumers ...string) {
+	pool := q.pooledConnection
+	resetReliableQueue(pool, q, consumers...)
+	deleteKey(pool, q.attemptsKey())
+	deleteKey(pool, q.errorsKey())
+	deleteKey(pool, q.deadKey())
+}
+
+func TestQueueNackMovesToDeadLetterAfterMaxAttempts(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_dead_nack")
+	q.MaxAttempts = 2
+	resetDeadLetterQueue(q, "worker1")
+
+	q.Push("foo")
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if d.Attempts != 1 {
+		t.Error("Expected first attempt, was: ", d.Attempts)
+	}
+	d.NackWithError(true, errors.New("boom"))
+
+	if d, err = q.ReliablePop("worker1", 1); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if d.Attempts != 2 {
+		t.Error("Expected second attempt, was: ", d.Attempts)
+	}
+	d.Nack(true)
+
+	if l, _ := q.Length(); l != 0 {
+		t.Error("Expected empty queue, was: ", l)
+	}
+	letters, err := q.DeadLetters(0, -1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(letters) != 1 {
+		t.Fatal("Expected 1 dead letter, got: ", len(letters))
+	}
+	letter := letters[0]
+	if letter.Value != "foo" || letter.Reason != DeadReasonNacked || letter.Error != "boom" || letter.Attempts != 2 {
+		t.Errorf("Unexpected dead letter: %+v", letter)
+	}
+}
+
+func TestQueueIdenticalPayloadsKeepSeparateAttempts(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_dead_identical")
+	q.MaxAttempts = 2
+	resetDeadLetterQueue(q, "worker1")
+
+	q.PushMessage(NewMessage("job"))
+	q.PushMessage(NewMessage("job"))
+	first, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	second, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if first.Attempts != 1 || second.Attempts != 1 {
+		t.Error("Expected each message's first attempt, got: ", first.Attempts, second.Attempts)
+	}
+
+	first.Nack(true)
+	second.Ack()
+	if first, err = q.ReliablePop("worker1", 1); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if first.Attempts != 2 {
+		t.Error("Expected the ack of the other message to keep this one's history, attempts were: ", first.Attempts)
+	}
+	first.Ack()
+	if l, _ := q.DeadLength(); l != 0 {
+		t.Error("Expected no dead letters, got: ", l)
+	}
+
+	// identical bare values share one history
+	q.PushBatch([]string{"job", "job"})
+	q.ReliablePop("worker1", 1)
+	if d, err := q.ReliablePop("worker1", 1); err != nil || d.Attempts != 2 {
+		t.Error("Expected identical bare values to share attempts, got: ", d, err)
+	}
+}
+
+func TestQueueExpiredMovesToDeadLetterAfterMaxAttempts(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_dead_expired")
+	q.MaxAttempts = 1
+	q.VisibilityTimeout = 10 * time.Millisecond
+	resetDeadLetterQueue(q, "worker1")
+
+	q.Push("foo")
+	if _, err := q.ReliablePop("worker1", 1); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n, err := q.RequeueExpired(); n != 1 || err != nil {
+		t.Error("Expected 1 expired message, got: ", n, err)
+	}
+
+	if l, _ := q.Length(); l != 0 {
+		t.Error("Expected empty queue, was: ", l)
+	}
+	if l, _ := q.DeadLength(); l != 1 {
+		t.Error("Expected 1 dead letter, was: ", l)
+	}
+	letters, _ := q.DeadLetters(0, 0)
+	if len(letters) != 1 || letters[0].Reason != DeadReasonExpired {
+		t.Errorf("Unexpected dead letters: %+v", letters)
+	}
+}
+
+func TestQueueReplayDead(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_dead_replay")
+	q.MaxAttempts = 1
+	resetDeadLetterQueue(q, "worker1")
+
+	for _, value := range []string{"foo", "bar"} {
+		q.Push(value)
+		d, err := q.ReliablePop("worker1", 1)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		d.Nack(true)
+	}
+
+	if n, err := q.ReplayDead(10); n != 2 || err != nil {
+		t.Error("Expected 2 messages replayed, got: ", n, err)
+	}
+	if l, _ := q.DeadLength(); l != 0 {
+		t.Error("Expected empty dead-letter list, was: ", l)
+	}
+
+	for _, expected := range []string{"foo", "bar"} {
+		d, err := q.ReliablePop("worker1", 1)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if d.Value != expected {
+			t.Errorf("Expected %s but got: %s", expected, d.Value)
+		}
+		if d.Attempts != 1 {
+			t.Error("Expected attempts to be reset, was: ", d.Attempts)
+		}
+		d.Ack()
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// promoteBatchSize is the maximum number of due messages moved onto the
+// queue by a single transaction.
+const promoteBatchSize = 100
+
+// PushAt will park the value in the queue's delayed set until the given time,
+// after which PromoteDue will push it onto the queue.  Values due now or in
+// the past are pushed immediately.
+func (queue *Queue) PushAt(value string, due time.Time) error {
+	if !due.After(time.Now()) {
+		return queue.Push(value)
+	}
+
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	_, err := c.Do("ZADD", queue.delayedKey(), unixMillis(due), newID()+":"+value)
+	return err
+}
+
+// PushAfter will park the value in the queue's delayed set until the given
+// delay has elapsed.
+func (queue *Queue) PushAfter(value string, delay time.Duration) error {
+	return queue.PushAt(value, time.Now().Add(delay))
+}
+
+// PromoteDue moves every delayed message whose due time has passed onto the
+// queue, in due time order, and returns the number of messages moved.
+func (queue *Queue) PromoteDue() (promoted int, err error) {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	delayedKey := queue.delayedKey()
+	for {
+		if _, err = c.Do("WATCH", delayedKey); err != nil {
+			return
+		}
+
+		var members []string
+		if members, err = redis.Strings(c.Do("ZRANGEBYSCORE", delayedKey, "-inf", unixMillis(time.Now()), "LIMIT", 0, promoteBatchSize)); err != nil {
+			return
+		}
+		if len(members) == 0 {
+			c.Do("UNWATCH")
+			return
+		}
+
+		c.Send("MULTI")
+		for _, member := range members {
+			c.Send("ZREM", delayedKey, member)
+			c.Send("LPUSH", queue.key, delayedValue(member))
+		}
+		var reply interface{}
+		if reply, err = c.Do("EXEC"); err != nil {
+			return
+		}
+		if reply == nil {
+			// the delayed set changed while it was being watched, try again
+			continue
+		}
+
+		promoted = promoted + len(members)
+		if len(members) < promoteBatchSize {
+			return
+		}
+	}
+}
+
+func (queue *Queue) delayedKey() string {
+	return queue.key + ":delayed"
+}
+
+// delayedValue strips the unique prefix that allows identical values to be
+// scheduled more than once from a delayed set member.
+func delayedValue(member string) string {
+	if i := strings.Index(member, ":"); i >= 0 {
+		return member[i+1:]
+	}
+	return member
+}
+
+// newID returns a random 128-bit identifier encoded as hex.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Promoter periodically calls PromoteDue on a queue so that delayed messages
+// become available once they are due.
+type Promoter struct {
+	queue    *Queue
+	interval time.Duration
+
+	// ErrorHandler, if set, is called with any error returned by PromoteDue.
+	// It must be set before the promoter is started.
+	ErrorHandler func(error)
+
+	runner periodic
+}
+
+// NewPromoter creates a Promoter for the queue that runs at the given
+// interval once started.
+func NewPromoter(queue *Queue, interval time.Duration) *Promoter {
+	return &Promoter{queue: queue, interval: interval}
+}
+
+// Start begins promoting due messages in the background.  Calling Start on a
+// running promoter has no effect.
+func (p *Promoter) Start() {
+	p.runner.start(p.interval, p.promote)
+}
+
+// Stop stops the promoter, waiting for any pass in progress to complete.
+func (p *Promoter) Stop() {
+	p.runner.stop()
+}
+
+func (p *Promoter) promote() {
+	if _, err := p.queue.PromoteDue(); err != nil && p.ErrorHandler != nil {
+		p.ErrorHandler(err)
+	}
+}
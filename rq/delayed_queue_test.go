@@ -0,0 +1,99 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueuePushAfterPromoteDue(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_delayed")
+	deleteKey(pool, q.key)
+	deleteKey(pool, q.delayedKey())
+
+	if err := q.PushAfter("later", 30*time.Millisecond); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	q.PushAfter("sooner", 10*time.Millisecond)
+	q.PushAfter("sooner", 10*time.Millisecond)
+
+	if n, err := q.PromoteDue(); n != 0 || err != nil {
+		t.Error("Expected nothing promoted, got: ", n, err)
+	}
+	if l, _ := q.Length(); l != 0 {
+		t.Error("Expected empty queue, was: ", l)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if n, err := q.PromoteDue(); n != 3 || err != nil {
+		t.Error("Expected 3 messages promoted, got: ", n, err)
+	}
+
+	for _, expected := range []string{"sooner", "sooner", "later"} {
+		value, err := q.Pop(1)
+		if value != expected {
+			t.Errorf("Expected %s but got: %s", expected, value)
+		}
+		if err != nil {
+			t.Error("Unexpected error: ", err)
+		}
+	}
+}
+
+func TestQueuePushAtPastIsImmediate(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_delayed_past")
+	deleteKey(pool, q.key)
+	deleteKey(pool, q.delayedKey())
+
+	if err := q.PushAt("foo", time.Now().Add(-time.Minute)); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if l, _ := q.Length(); l != 1 {
+		t.Error("Expected length to be 1, was: ", l)
+	}
+	q.Pop(1)
+}
+
+func TestPromoterStartStop(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_promoter")
+	deleteKey(pool, q.key)
+	deleteKey(pool, q.delayedKey())
+
+	q.PushAfter("foo", 10*time.Millisecond)
+
+	// the test pools only allow a single connection, so the promoter needs its own
+	promoterPool := createPool()
+	defer promoterPool.Close()
+
+	p := NewPromoter(QueueConnect(promoterPool, "rq_test_promoter"), 5*time.Millisecond)
+	p.Start()
+	defer p.Stop()
+
+	value, err := q.Pop(1)
+	if value != "foo" {
+		t.Error("Expected promoted foo but got: ", value)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
@@ -16,6 +16,8 @@
 package rq
 
 import (
+	"context"
+	"errors"
 	"math"
 	"sync"
 	"time"
@@ -23,59 +25,311 @@ import (
 	"github.com/garyburd/redigo/redis"
 )
 
+var (
+	errProbeTimeout    = errors.New("Probe timed out")
+	errProbeInProgress = errors.New("Previous probe has not completed")
+)
+
+// ErrorDecayOptions tunes how quickly an ErrorDecayQueue is marked unhealthy
+// and how quickly it recovers.  Zero fields take the default values.
+type ErrorDecayOptions struct {
+	// HalfLife is the time taken for the error rating to decay by half.
+	// Defaults to 10 seconds.
+	HalfLife time.Duration
+
+	// Increment is added to the error rating for each recorded error.
+	// Defaults to 0.1.
+	Increment float64
+
+	// Threshold is the error rating at or above which the queue is
+	// unhealthy.  Defaults to 0.1.
+	Threshold float64
+
+	// ProbeCommand is issued to a server whose error rating has decayed
+	// below the threshold before it is considered healthy again.  Defaults
+	// to PING.
+	ProbeCommand string
+
+	// ProbeTimeout is how long a probe waits for a reply before it is
+	// recorded as failed.  Defaults to one second.
+	ProbeTimeout time.Duration
+
+	// Clock returns the current time.  Defaults to time.Now.
+	Clock func() time.Time
+}
+
+func (o ErrorDecayOptions) withDefaults() ErrorDecayOptions {
+	if o.HalfLife <= 0 {
+		o.HalfLife = 10 * time.Second
+	}
+	if o.Increment <= 0 {
+		o.Increment = 0.1
+	}
+	if o.Threshold <= 0 {
+		o.Threshold = 0.1
+	}
+	if o.ProbeCommand == "" {
+		o.ProbeCommand = "PING"
+	}
+	if o.ProbeTimeout <= 0 {
+		o.ProbeTimeout = time.Second
+	}
+	if o.Clock == nil {
+		o.Clock = time.Now
+	}
+	return o
+}
+
 type ErrorDecayQueue struct {
 	server           string
 	queueName        string
 	pooledConnection *redis.Pool
 	errorRating      float64
-	errorRatingTime  int64
+	errorRatingTime  time.Time
+	options          ErrorDecayOptions
+
+	lastProbe        time.Time
+	lastProbeLatency time.Duration
+	lastProbeError   error
+	probing          bool
+
+	observers []func(server string, healthy bool, rating float64)
 
 	mu sync.Mutex
 }
 
 func NewErrorDecayQueue(server string, queueName string, pooledConnection *redis.Pool) *ErrorDecayQueue {
+	return NewErrorDecayQueueWithOptions(server, queueName, pooledConnection, ErrorDecayOptions{})
+}
+
+// NewErrorDecayQueueWithOptions creates an ErrorDecayQueue with the given
+// error decay parameters.
+func NewErrorDecayQueueWithOptions(server string, queueName string, pooledConnection *redis.Pool, options ErrorDecayOptions) *ErrorDecayQueue {
+	options = options.withDefaults()
 	return &ErrorDecayQueue{
 		server:           server,
 		queueName:        queueName,
 		pooledConnection: pooledConnection,
-		errorRatingTime:  time.Now().Unix(),
+		errorRatingTime:  options.Clock(),
 		errorRating:      0.0,
+		options:          options,
 	}
 }
 
+// OnHealthChange registers a function to be called whenever the queue moves
+// between healthy and unhealthy, with the new state and error rating.  It is
+// called on the goroutine that caused the change, after the queue's lock is
+// released.
+func (e *ErrorDecayQueue) OnHealthChange(fn func(server string, healthy bool, rating float64)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.observers = append(e.observers, fn)
+}
+
+// transition locks the queue and returns a function that unlocks it and
+// notifies the observers if the health of the queue changed in between.
+func (e *ErrorDecayQueue) transition() func() {
+	e.mu.Lock()
+	wasHealthy := e.errorRating < e.options.Threshold
+
+	return func() {
+		healthy := e.errorRating < e.options.Threshold
+		rating := e.errorRating
+		observers := e.observers
+		e.mu.Unlock()
+
+		if healthy != wasHealthy {
+			for _, fn := range observers {
+				fn(e.server, healthy, rating)
+			}
+		}
+	}
+}
+
+// Server returns the name of the queue's server.
+func (e *ErrorDecayQueue) Server() string {
+	return e.server
+}
+
+// QueueName returns the name of the queue's list.
+func (e *ErrorDecayQueue) QueueName() string {
+	return e.queueName
+}
+
 func (e *ErrorDecayQueue) QueueError() {
+	defer e.transition()()
+
+	e.errorRating = e.errorRating + e.options.Increment
+}
+
+// ErrorRating returns the error rating as of the last health check.
+func (e *ErrorDecayQueue) ErrorRating() float64 {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	e.errorRating = e.errorRating + 0.1
+	return e.errorRating
 }
 
-func (e *ErrorDecayQueue) IsHealthy() (healthy bool) {
+// BackendStatus describes the health of a single server behind a
+// MultiQueue.
+type BackendStatus struct {
+	Server string
+
+	// Healthy reports whether the server was healthy at the last check.  A
+	// server whose error rating has decayed below the threshold is not
+	// healthy again until a probe succeeds.
+	Healthy bool
+
+	// ErrorRating is the error rating decayed to the current time.
+	ErrorRating float64
+
+	// LastProbe is when the server was last probed, or the zero time if it
+	// never has been.
+	LastProbe        time.Time
+	LastProbeLatency time.Duration
+	LastProbeError   error
+}
+
+// Status returns the current health of the queue's server without
+// contacting it.
+func (e *ErrorDecayQueue) Status() BackendStatus {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	now := time.Now().Unix()
-	timeDelta := now - e.errorRatingTime
-	updatedErrorRating := e.errorRating * math.Exp((math.Log(0.5)/10)*float64(timeDelta))
+	return BackendStatus{
+		Server:           e.server,
+		Healthy:          e.errorRating < e.options.Threshold,
+		ErrorRating:      e.decayedErrorRating(e.options.Clock()),
+		LastProbe:        e.lastProbe,
+		LastProbeLatency: e.lastProbeLatency,
+		LastProbeError:   e.lastProbeError,
+	}
+}
 
-	if e.errorRating < 0.1 {
-		healthy = true
-	} else {
-		if updatedErrorRating < 0.1 {
-			// transitioning the queue out of an unhealthy state, try issuing a ping
-			conn := e.pooledConnection.Get()
-			defer conn.Close()
-
-			if _, err := conn.Do("PING"); err == nil {
-				healthy = true
-			} else {
-				// unsuccessful at using new connection, put it back into an unhealthy state
-				healthy = false
-				updatedErrorRating = e.errorRating + 0.1
-			}
-		} else {
-			healthy = false
+// Probe issues the probe command to the server and updates the queue's
+// health.  A failed probe is recorded as an error, while a successful probe
+// lets a server whose error rating has decayed below the threshold return to
+// service without waiting for traffic to reach it.
+func (e *ErrorDecayQueue) Probe() (healthy bool) {
+	return e.probeHealth(context.Background())
+}
+
+// probeHealth behaves like Probe, leaving the queue's health unchanged if
+// the context is cancelled before the probe completes.
+func (e *ErrorDecayQueue) probeHealth(ctx context.Context) (healthy bool) {
+	err := e.probe(ctx)
+
+	defer e.transition()()
+
+	now := e.options.Clock()
+	updatedErrorRating := e.decayedErrorRating(now)
+	if err == context.Canceled {
+		return e.errorRating < e.options.Threshold
+	}
+	if err != nil {
+		updatedErrorRating = updatedErrorRating + e.options.Increment
+	}
+	e.errorRatingTime = now
+	e.errorRating = updatedErrorRating
+	return updatedErrorRating < e.options.Threshold
+}
+
+// probe issues the probe command, recording its latency and result.  It
+// must be called without holding the lock, and gives up after the
+// ProbeTimeout or when the context is cancelled.  Only one probe is
+// outstanding at a time, so a server that stops answering does not collect
+// stuck probes: later probes fail until the outstanding one completes.
+func (e *ErrorDecayQueue) probe(ctx context.Context) error {
+	e.mu.Lock()
+	outstanding := e.probing
+	e.probing = true
+	e.mu.Unlock()
+
+	start := e.options.Clock()
+	err := errProbeInProgress
+	if !outstanding {
+		err = e.issueProbe(ctx)
+	}
+	if err == context.Canceled {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastProbe = e.options.Clock()
+	e.lastProbeLatency = e.lastProbe.Sub(start)
+	e.lastProbeError = err
+	return err
+}
+
+// issueProbe runs the probe command on a pooled connection in the
+// background, clearing the outstanding probe once it completes.
+func (e *ErrorDecayQueue) issueProbe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.options.ProbeTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		conn := e.pooledConnection.Get()
+		_, err := conn.Do(e.options.ProbeCommand)
+		conn.Close()
+
+		e.mu.Lock()
+		e.probing = false
+		e.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return errProbeTimeout
 		}
+		return ctx.Err()
+	}
+}
+
+// decayedErrorRating returns the error rating decayed to the given time.
+func (e *ErrorDecayQueue) decayedErrorRating(now time.Time) float64 {
+	timeDelta := now.Sub(e.errorRatingTime)
+	return e.errorRating * math.Exp((math.Log(0.5)/e.options.HalfLife.Seconds())*timeDelta.Seconds())
+}
+
+// IsHealthy reports whether the queue's error rating is below the
+// threshold.  A queue whose rating has decayed below the threshold since it
+// was marked unhealthy is probed, without holding the lock, before it is
+// returned to service.
+func (e *ErrorDecayQueue) IsHealthy() (healthy bool) {
+	e.mu.Lock()
+	now := e.options.Clock()
+	updatedErrorRating := e.decayedErrorRating(now)
+	transitioning := e.errorRating >= e.options.Threshold && updatedErrorRating < e.options.Threshold
+	if !transitioning {
+		healthy = e.errorRating < e.options.Threshold
+		e.errorRatingTime = now
+		e.errorRating = updatedErrorRating
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+
+	// transitioning the queue out of an unhealthy state, try issuing a probe
+	err := e.probe(context.Background())
+
+	defer e.transition()()
+
+	now = e.options.Clock()
+	if err == nil {
+		updatedErrorRating = e.decayedErrorRating(now)
+		healthy = updatedErrorRating < e.options.Threshold
+	} else {
+		// unsuccessful at using new connection, put it back into an unhealthy state
+		healthy = false
+		updatedErrorRating = e.errorRating + e.options.Increment
 	}
 	e.errorRatingTime = now
 	e.errorRating = updatedErrorRating
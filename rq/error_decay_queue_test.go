@@ -0,0 +1,295 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/skidder/redis-queue/rqtest"
+)
+
+// fakeClock is a manually advanced clock for driving error decay.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1400000000, 0)}
+}
+
+// startProxy starts a fault-injecting proxy to the test server, closed when
+// the test ends.
+func startProxy(t *testing.T) *rqtest.Proxy {
+	proxy, err := rqtest.NewProxy(testServer.Addr())
+	if err != nil {
+		t.Fatal("Unable to start proxy: ", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	return proxy
+}
+
+func TestErrorDecayQueueDefaults(t *testing.T) {
+	clock := newFakeClock()
+	pool := createPool()
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("local", "rq_test_decay", pool, ErrorDecayOptions{Clock: clock.Now})
+
+	if !q.IsHealthy() {
+		t.Error("Expected new queue to be healthy")
+	}
+	q.QueueError()
+	q.QueueError()
+	if q.IsHealthy() {
+		t.Error("Expected queue to be unhealthy after two errors")
+	}
+
+	clock.Advance(9 * time.Second)
+	if q.IsHealthy() {
+		t.Error("Expected queue to remain unhealthy before the half-life has passed")
+	}
+	clock.Advance(2 * time.Second)
+	if !q.IsHealthy() {
+		t.Error("Expected queue to be healthy after the half-life, rating: ", q.ErrorRating())
+	}
+}
+
+func TestErrorDecayQueueSubSecondDecay(t *testing.T) {
+	clock := newFakeClock()
+	pool := createPool()
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("local", "rq_test_decay", pool, ErrorDecayOptions{
+		HalfLife:  time.Second,
+		Increment: 1,
+		Threshold: 0.4,
+		Clock:     clock.Now,
+	})
+
+	q.QueueError()
+	clock.Advance(500 * time.Millisecond)
+	if q.IsHealthy() {
+		t.Error("Expected queue to be unhealthy")
+	}
+	if rating := q.ErrorRating(); math.Abs(rating-math.Sqrt(0.5)) > 1e-9 {
+		t.Error("Expected rating to decay by a factor of sqrt(2) in half a half-life, got: ", rating)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	q.IsHealthy()
+	if rating := q.ErrorRating(); math.Abs(rating-0.5) > 1e-9 {
+		t.Error("Expected rating to halve in one half-life, got: ", rating)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if !q.IsHealthy() {
+		t.Error("Expected queue to recover below the threshold, rating: ", q.ErrorRating())
+	}
+}
+
+func TestErrorDecayQueueFailedProbe(t *testing.T) {
+	clock := newFakeClock()
+	pool := createPoolWithConnectString("127.0.0.1:1")
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("unreachable", "rq_test_decay", pool, ErrorDecayOptions{
+		HalfLife:  time.Second,
+		Increment: 0.5,
+		Threshold: 0.5,
+		Clock:     clock.Now,
+	})
+
+	q.QueueError()
+	clock.Advance(2 * time.Second)
+	if q.IsHealthy() {
+		t.Error("Expected queue to remain unhealthy after a failed probe")
+	}
+	if rating := q.ErrorRating(); rating != 1.0 {
+		t.Error("Expected a failed probe to add the increment, got: ", rating)
+	}
+}
+
+func TestErrorDecayQueueProbeCommand(t *testing.T) {
+	clock := newFakeClock()
+	pool := createPool()
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("local", "rq_test_decay", pool, ErrorDecayOptions{
+		ProbeCommand: "NOSUCHCOMMAND",
+		Clock:        clock.Now,
+	})
+
+	q.QueueError()
+	clock.Advance(time.Minute)
+	if q.IsHealthy() {
+		t.Error("Expected an error reply to the probe command to keep the queue unhealthy")
+	}
+}
+
+func TestErrorDecayQueueProbe(t *testing.T) {
+	clock := newFakeClock()
+	pool := createPool()
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("local", "rq_test_decay", pool, ErrorDecayOptions{Clock: clock.Now})
+
+	q.QueueError()
+	q.QueueError()
+	if q.Probe() {
+		t.Error("Expected queue to remain unhealthy until its rating decays")
+	}
+	if status := q.Status(); status.Healthy || status.LastProbe != clock.Now() || status.LastProbeError != nil {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	clock.Advance(11 * time.Second)
+	if !q.Probe() {
+		t.Error("Expected a successful probe to return the queue to service")
+	}
+	if status := q.Status(); !status.Healthy {
+		t.Errorf("Expected healthy status: %+v", status)
+	}
+}
+
+func TestErrorDecayQueueOnHealthChange(t *testing.T) {
+	clock := newFakeClock()
+	pool := createPool()
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("local", "rq_test_decay", pool, ErrorDecayOptions{Clock: clock.Now})
+
+	var states []bool
+	var ratings []float64
+	q.OnHealthChange(func(server string, healthy bool, rating float64) {
+		if server != "local" {
+			t.Error("Unexpected server: ", server)
+		}
+		states = append(states, healthy)
+		ratings = append(ratings, rating)
+	})
+
+	q.QueueError()
+	q.QueueError()
+	if len(states) != 1 || states[0] || ratings[0] != 0.1 {
+		t.Error("Expected a single change to unhealthy, got: ", states, ratings)
+	}
+
+	clock.Advance(time.Minute)
+	q.IsHealthy()
+	q.IsHealthy()
+	if len(states) != 2 || !states[1] {
+		t.Error("Expected a single change back to healthy, got: ", states)
+	}
+}
+
+func TestErrorDecayQueueRecoversFromOutage(t *testing.T) {
+	clock := newFakeClock()
+	proxy := startProxy(t)
+	pool := createPoolWithConnectString(proxy.Addr())
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("proxied", "rq_test_decay", pool, ErrorDecayOptions{
+		HalfLife:  time.Second,
+		Increment: 0.5,
+		Threshold: 0.4,
+		Clock:     clock.Now,
+	})
+	var states []bool
+	q.OnHealthChange(func(server string, healthy bool, rating float64) {
+		states = append(states, healthy)
+	})
+
+	proxy.SetDown(true)
+	if err := QueueConnect(pool, "rq_test_decay").Push("foo"); err == nil {
+		t.Fatal("Expected the push to fail while the server is down")
+	}
+	q.QueueError()
+	if q.IsHealthy() {
+		t.Error("Expected the queue to be unhealthy after an error")
+	}
+
+	clock.Advance(time.Second)
+	if q.IsHealthy() {
+		t.Error("Expected the probe to fail while the server is down")
+	}
+	if status := q.Status(); status.LastProbeError == nil || status.ErrorRating != 1.0 {
+		t.Errorf("Expected the failed probe to be recorded: %+v", status)
+	}
+
+	proxy.SetDown(false)
+	clock.Advance(time.Second)
+	if q.IsHealthy() {
+		t.Error("Expected the queue to stay unhealthy until its rating decays")
+	}
+	clock.Advance(time.Second)
+	if !q.IsHealthy() {
+		t.Error("Expected a successful probe to return the queue to service, rating: ", q.ErrorRating())
+	}
+	if len(states) != 2 || states[0] || !states[1] {
+		t.Error("Expected unhealthy then healthy transitions, got: ", states)
+	}
+	if err := QueueConnect(pool, "rq_test_decay").Push("foo"); err != nil {
+		t.Error("Expected the push to succeed once the server is back, got: ", err)
+	}
+	deleteKey(pool, "rq_test_decay")
+}
+
+func TestErrorDecayQueueProbeFailures(t *testing.T) {
+	clock := newFakeClock()
+	proxy := startProxy(t)
+	pool := createPoolWithConnectString("redis://" + proxy.Addr() + "?read_timeout=200ms")
+	defer pool.Close()
+	q := NewErrorDecayQueueWithOptions("proxied", "rq_test_decay", pool, ErrorDecayOptions{Clock: clock.Now})
+
+	proxy.FailCommand("PING", "")
+	if q.Probe() {
+		t.Error("Expected an error reply to fail the probe")
+	}
+	if err := q.Status().LastProbeError; err == nil || err.Error() != rqtest.DefaultFailure {
+		t.Error("Expected the injected failure to be recorded, got: ", err)
+	}
+
+	proxy.Reset()
+	proxy.SetBlackhole(true)
+	clock.Advance(time.Minute)
+	if q.Probe() {
+		t.Error("Expected an unanswered probe to time out")
+	}
+
+	proxy.Reset()
+	clock.Advance(time.Minute)
+	if !q.Probe() {
+		t.Error("Expected the probe to succeed once the faults are removed, got: ", q.Status().LastProbeError)
+	}
+}
+
+func TestErrorDecayQueueProbeLatency(t *testing.T) {
+	proxy := startProxy(t)
+	pool := createPoolWithConnectString(proxy.Addr())
+	defer pool.Close()
+	q := NewErrorDecayQueue("proxied", "rq_test_decay", pool)
+
+	proxy.SetLatency(50 * time.Millisecond)
+	if !q.Probe() {
+		t.Fatal("Expected a slow probe to succeed")
+	}
+	if latency := q.Status().LastProbeLatency; latency < 50*time.Millisecond {
+		t.Error("Expected the probe latency to include the delay, got: ", latency)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrTimeout is returned by every pop when no message arrived before the
+	// timeout.  For compatibility with callers written against earlier
+	// versions, errors.Is(ErrTimeout, redis.ErrNil) is true.
+	ErrTimeout error = timeoutError{}
+
+	// ErrNoQueuesAvailable is returned by a MultiQueue with no queue that
+	// can be used.
+	ErrNoQueuesAvailable = errors.New("No queues available")
+
+	// ErrDeliveryNotFound is returned when settling a Delivery that is no
+	// longer on its processing list.
+	ErrDeliveryNotFound = errors.New("Delivery not found in processing list")
+
+	// ErrInvalidPriority is returned for a priority level outside the
+	// levels of a PriorityQueue.
+	ErrInvalidPriority = errors.New("Priority level out of range")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "Timed out waiting for a message"
+}
+
+func (timeoutError) Is(target error) bool {
+	return target == redis.ErrNil
+}
+
+// timeoutOrError replaces the nil reply error returned by a blocking pop
+// that timed out with ErrTimeout.
+func timeoutOrError(err error) error {
+	if err == redis.ErrNil {
+		return ErrTimeout
+	}
+	return err
+}
+
+// BackendError is returned when a command fails on one of the servers
+// behind a MultiQueue.  The failure has been recorded against the server,
+// and Rating is its error rating afterwards.
+type BackendError struct {
+	Server string
+	Queue  string
+	Rating float64
+	Err    error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("Recorded error for queue: server=%s, queueName=%s, error rating=%f: %v", e.Server, e.Queue, e.Rating, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// recordError records the error against the queue and returns it wrapped in
+// a *BackendError.
+func recordError(q *ErrorDecayQueue, err error) error {
+	q.QueueError()
+	return &BackendError{Server: q.server, Queue: q.queueName, Rating: q.ErrorRating(), Err: err}
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestPopTimeoutsAreConsistent(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_timeout")
+
+	if _, err := QueueConnect(pool, "rq_test_timeout").Pop(1); err != ErrTimeout {
+		t.Error("Expected timeout error from Queue, got: ", err)
+	}
+	if _, err := QueueConnect(pool, "rq_test_timeout").PopBatch(10, 1); err != ErrTimeout {
+		t.Error("Expected timeout error from Queue batch, got: ", err)
+	}
+	if _, err := NewMultiQueue(map[string]*redis.Pool{"foo1": pool}, "rq_test_timeout").Pop(1); err != ErrTimeout {
+		t.Error("Expected timeout error from MultiQueue, got: ", err)
+	}
+	if _, err := NewPriorityQueue(pool, "rq_test_timeout", 2).Pop(1); err != ErrTimeout {
+		t.Error("Expected timeout error from PriorityQueue, got: ", err)
+	}
+	if !errors.Is(ErrTimeout, redis.ErrNil) {
+		t.Error("Expected timeout error to match redis.ErrNil")
+	}
+}
+
+func TestBackendErrorUnwraps(t *testing.T) {
+	cause := errors.New("connection refused")
+	var err error = &BackendError{Server: "foo1", Queue: "rq_test_queue", Rating: 0.1, Err: cause}
+	if !errors.Is(err, cause) {
+		t.Error("Expected backend error to wrap its cause")
+	}
+	if err.Error() != "Recorded error for queue: server=foo1, queueName=rq_test_queue, error rating=0.100000: connection refused" {
+		t.Error("Unexpected message: ", err.Error())
+	}
+}
+
+func TestMultiQueueNoQueuesAvailable(t *testing.T) {
+	q := NewMultiQueue(map[string]*redis.Pool{}, "rq_test_queue")
+	if err := q.Push("foo"); err != ErrNoQueuesAvailable {
+		t.Error("Expected no queues available error, got: ", err)
+	}
+	if _, err := q.Pop(1); err != ErrNoQueuesAvailable {
+		t.Error("Expected no queues available error, got: ", err)
+	}
+}
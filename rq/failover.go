@@ -0,0 +1,112 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PushAttempt records a failed attempt to push to one server.
+type PushAttempt struct {
+	Server string
+	Err    error
+}
+
+// PushError is returned by a MultiQueue push that failed on every server it
+// was attempted on.
+type PushError struct {
+	Attempts []PushAttempt
+}
+
+func (e *PushError) Error() string {
+	attempts := make([]string, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		attempts = append(attempts, fmt.Sprintf("server=%s: %v", attempt.Server, attempt.Err))
+	}
+	return fmt.Sprintf("Push failed after %d attempts: %s", len(e.Attempts), strings.Join(attempts, "; "))
+}
+
+// Unwrap returns the error from every attempt.
+func (e *PushError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		errs = append(errs, attempt.Err)
+	}
+	return errs
+}
+
+// push runs LPUSH with the given values on a selected queue.  A failure is
+// recorded against the queue and, while retries remain, the push is tried
+// again on a different healthy queue after a backoff that doubles with each
+// retry.  A *PushError listing every attempt is returned if all of them
+// fail.
+func (m *MultiQueue) push(ctx context.Context, values []string) error {
+	tried := map[*ErrorDecayQueue]bool{}
+	pushErr := &PushError{}
+	backoff := m.pushBackoff
+
+	for attempt := 0; attempt <= m.pushRetries; attempt++ {
+		if attempt > 0 && backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff = backoff * 2
+		}
+
+		q, err := m.selectQueue(tried)
+		if err != nil {
+			if attempt == 0 {
+				return err
+			}
+			break
+		}
+		tried[q] = true
+
+		_, err = doContext(ctx, q.pooledConnection, "LPUSH", batchArgs(m.queueName, values)...)
+		if err == nil {
+			return nil
+		}
+		if err == ctx.Err() {
+			return err
+		}
+		pushErr.Attempts = append(pushErr.Attempts, PushAttempt{Server: q.server, Err: recordError(q, err)})
+	}
+	return pushErr
+}
+
+// selectQueue chooses a queue with the selector, passing over the excluded
+// queues.  When nothing has been excluded and no queue is healthy, the
+// selector chooses from every queue.
+func (m *MultiQueue) selectQueue(exclude map[*ErrorDecayQueue]bool) (*ErrorDecayQueue, error) {
+	candidates := []*ErrorDecayQueue{}
+	for _, q := range m.HealthyQueues() {
+		if !exclude[q] {
+			candidates = append(candidates, q)
+		}
+	}
+	if len(candidates) > 0 {
+		return m.selector.Select(candidates)
+	}
+	if len(exclude) > 0 || len(m.queues) == 0 {
+		return nil, ErrNoQueuesAvailable
+	}
+	return m.selector.Select(m.queues)
+}
@@ -0,0 +1,135 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// preferDownSelector always chooses a server named "down" when it is
+// offered one.
+var preferDownSelector = SelectorFunc(func(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	for _, q := range queues {
+		if q.Server() == "down" {
+			return q, nil
+		}
+	}
+	return queues[0], nil
+})
+
+func TestMultiQueuePushFailsOver(t *testing.T) {
+	up := createPoolWithConnectString(testConnectString(1))
+	defer up.Close()
+	down := NewPool(":123", 1, 1, 240*time.Second)
+	defer down.Close()
+	deleteKey(up, "rq_test_failover")
+
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"up": up, "down": down}, "rq_test_failover", MultiQueueOptions{
+		Selector:    preferDownSelector,
+		PushRetries: 1,
+		PushBackoff: 50 * time.Millisecond,
+	})
+	start := time.Now()
+	if err := q.Push("foo"); err != nil {
+		t.Error("Expected the push to fail over, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error("Expected the retry to back off, took: ", elapsed)
+	}
+	if l, _ := QueueConnect(up, "rq_test_failover").Length(); l != 1 {
+		t.Error("Expected the value on the up server, length was: ", l)
+	}
+	if q.Status()[0].ErrorRating == 0 {
+		t.Error("Expected the failure to be recorded against the down server")
+	}
+
+	deleteKey(up, "rq_test_failover")
+}
+
+func TestMultiQueuePushWithoutRetries(t *testing.T) {
+	up := createPoolWithConnectString(testConnectString(1))
+	defer up.Close()
+	down := NewPool(":123", 1, 1, 240*time.Second)
+	defer down.Close()
+
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"up": up, "down": down}, "rq_test_failover", MultiQueueOptions{
+		Selector: preferDownSelector,
+	})
+	err := q.Push("foo")
+	pushErr, ok := err.(*PushError)
+	if !ok {
+		t.Fatal("Expected a push error, got: ", err)
+	}
+	if len(pushErr.Attempts) != 1 || pushErr.Attempts[0].Server != "down" || pushErr.Attempts[0].Err == nil {
+		t.Errorf("Unexpected attempts: %+v", pushErr.Attempts)
+	}
+
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Fatal("Expected a backend error, got: ", err)
+	}
+	if backendErr.Server != "down" || backendErr.Queue != "rq_test_failover" || backendErr.Rating == 0 || backendErr.Err == nil {
+		t.Errorf("Unexpected backend error: %+v", backendErr)
+	}
+}
+
+func TestMultiQueuePushReportsEveryAttempt(t *testing.T) {
+	down1 := NewPool(":123", 1, 1, 240*time.Second)
+	defer down1.Close()
+	down2 := NewPool(":124", 1, 1, 240*time.Second)
+	defer down2.Close()
+
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"down1": down1, "down2": down2}, "rq_test_failover", MultiQueueOptions{
+		PushRetries: 5,
+	})
+	err := q.PushBatch([]string{"foo", "bar"})
+	pushErr, ok := err.(*PushError)
+	if !ok {
+		t.Fatal("Expected a push error, got: ", err)
+	}
+	if len(pushErr.Attempts) != 2 || pushErr.Attempts[0].Server == pushErr.Attempts[1].Server {
+		t.Errorf("Expected one attempt on each server: %+v", pushErr.Attempts)
+	}
+}
+
+func TestMultiQueuePushFailsOverOnErrorReplies(t *testing.T) {
+	proxy := startProxy(t)
+	failing := createPoolWithConnectString(proxy.Addr())
+	defer failing.Close()
+	up := createPoolWithConnectString(startServer(t).Addr())
+	defer up.Close()
+
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"down": failing, "up": up}, "rq_test_failover", MultiQueueOptions{
+		Selector:    preferDownSelector,
+		PushRetries: 1,
+	})
+	proxy.FailCommand("LPUSH", "READONLY You can't write against a read only replica.")
+	for i := 0; i < 3; i++ {
+		if err := q.Push("foo"); err != nil {
+			t.Error("Expected the push to fail over, got: ", err)
+		}
+	}
+	if l, _ := QueueConnect(up, "rq_test_failover").Length(); l != 3 {
+		t.Error("Expected every value on the up server, length was: ", l)
+	}
+	if status := q.Status(); status[0].Server != "down" || status[0].Healthy {
+		t.Errorf("Expected the failing server to be unhealthy: %+v", status[0])
+	}
+}
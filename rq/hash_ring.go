@@ -0,0 +1,82 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// hashRingVirtualNodes is the number of points each server is given on a
+// hashRing, which evens out the share of keys each server receives.
+const hashRingVirtualNodes = 160
+
+type hashRingPoint struct {
+	hash  uint32
+	queue *ErrorDecayQueue
+}
+
+// hashRing maps keys to queues by consistent hashing, so that adding or
+// removing a server only moves the keys of its neighbours on the ring.
+type hashRing struct {
+	points []hashRingPoint
+	size   int
+}
+
+func newHashRing(queues []*ErrorDecayQueue) *hashRing {
+	r := &hashRing{size: len(queues)}
+	for _, q := range queues {
+		for i := 0; i < hashRingVirtualNodes; i++ {
+			r.points = append(r.points, hashRingPoint{hash: hashKey(q.server + "#" + strconv.Itoa(i)), queue: q})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].queue.server < r.points[j].queue.server
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// queues returns every queue in the order they are reached walking the ring
+// clockwise from the key, starting with the key's primary queue.
+func (r *hashRing) queues(key string) []*ErrorDecayQueue {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	queues := make([]*ErrorDecayQueue, 0, r.size)
+	seen := make(map[*ErrorDecayQueue]bool, r.size)
+	for i := 0; i < len(r.points) && len(queues) < r.size; i++ {
+		q := r.points[(start+i)%len(r.points)].queue
+		if !seen[q] {
+			seen[q] = true
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
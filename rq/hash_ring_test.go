@@ -0,0 +1,112 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestHashRingIsStable(t *testing.T) {
+	queues := selectorTestQueues(nil, "foo1", "foo2", "foo3")
+	r1 := newHashRing(queues)
+	r2 := newHashRing([]*ErrorDecayQueue{queues[2], queues[0], queues[1]})
+
+	for i := 0; i < 100; i++ {
+		key := "video-" + strconv.Itoa(i)
+		order := r1.queues(key)
+		if len(order) != 3 {
+			t.Fatal("Expected every queue on the ring, got: ", order)
+		}
+		if order[0] != r2.queues(key)[0] {
+			t.Error("Expected the same queue regardless of construction order for key: ", key)
+		}
+	}
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	queues := selectorTestQueues(nil, "foo1", "foo2", "foo3")
+	r := newHashRing(queues)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[r.queues("video-" + strconv.Itoa(i))[0].Server()]++
+	}
+	for _, q := range queues {
+		if counts[q.Server()] < 700 || counts[q.Server()] > 1300 {
+			t.Error("Expected keys to be spread evenly, got: ", counts)
+		}
+	}
+}
+
+func TestHashRingRemovingServerOnlyMovesItsKeys(t *testing.T) {
+	queues := selectorTestQueues(nil, "foo1", "foo2", "foo3")
+	before := newHashRing(queues)
+	after := newHashRing(queues[:2])
+
+	for i := 0; i < 1000; i++ {
+		key := "video-" + strconv.Itoa(i)
+		order := before.queues(key)
+		if order[0] == queues[2] {
+			if after.queues(key)[0] != order[1] {
+				t.Error("Expected the key to move to the next server on the ring: ", key)
+			}
+		} else if after.queues(key)[0] != order[0] {
+			t.Error("Expected the key to stay on its server: ", key)
+		}
+	}
+}
+
+func TestMultiQueuePushWithKey(t *testing.T) {
+	pool1 := createPoolWithConnectString(testConnectString(1))
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(testConnectString(2))
+	defer pool2.Close()
+	deleteKey(pool1, "rq_test_multi_key")
+	deleteKey(pool2, "rq_test_multi_key")
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_key")
+	primary, _ := q.SelectQueueForKey("video-1")
+	for _, value := range []string{"1", "2", "3"} {
+		if err := q.PushWithKey("video-1", value); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	if l, _ := QueueConnect(primary.pooledConnection, "rq_test_multi_key").Length(); l != 3 {
+		t.Error("Expected every value on the key's server, length was: ", l)
+	}
+	for _, expected := range []string{"1", "2", "3"} {
+		if value, err := q.Pop(1); value != expected || err != nil {
+			t.Error("Expected ", expected, " but got: ", value, err)
+		}
+	}
+
+	primary.QueueError()
+	primary.QueueError()
+	fallback, _ := q.SelectQueueForKey("video-1")
+	if fallback == primary {
+		t.Error("Expected the next server on the ring when the key's server is unhealthy")
+	}
+	q.PushWithKey("video-1", "4")
+	if l, _ := QueueConnect(fallback.pooledConnection, "rq_test_multi_key").Length(); l != 1 {
+		t.Error("Expected the value on the fallback server, length was: ", l)
+	}
+
+	deleteKey(pool1, "rq_test_multi_key")
+	deleteKey(pool2, "rq_test_multi_key")
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errNegativeTimeout = errors.New("Timeout is negative")
+
+// MemoryQueue is an in-process queue with the same FIFO ordering and
+// blocking pop timeouts as Queue, for unit tests and single-process
+// deployments.  Messages are lost when the process exits.  The zero value is
+// an empty queue ready for use.
+type MemoryQueue struct {
+	mu       sync.Mutex
+	messages []string
+	changed  chan struct{}
+}
+
+// NewMemoryQueue creates an empty MemoryQueue.
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{}
+}
+
+// Push will add the value to the back of the queue.
+func (mq *MemoryQueue) Push(value string) error {
+	return mq.PushContext(context.Background(), value)
+}
+
+// PushContext behaves like Push, returning the context's error if it is
+// already done.
+func (mq *MemoryQueue) PushContext(ctx context.Context, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.PushBatch([]string{value})
+}
+
+// PushBatch will add the values to the back of the queue, so that they are
+// popped in the order given.
+func (mq *MemoryQueue) PushBatch(values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.messages = append(mq.messages, values...)
+	if mq.changed != nil {
+		close(mq.changed)
+		mq.changed = nil
+	}
+	return nil
+}
+
+// PushMessage will push the message onto the queue as an envelope, assigning
+// an ID and enqueue time if they are not set.
+func (mq *MemoryQueue) PushMessage(m *Message) error {
+	m.prepare()
+	return mq.Push(m.Encode())
+}
+
+// Pop will remove the value at the front of the queue, waiting up to timeout
+// seconds for one to be pushed, or forever if the timeout is zero.
+// ErrTimeout is returned if no message arrived before the timeout.
+func (mq *MemoryQueue) Pop(timeout int) (string, error) {
+	return mq.PopContext(context.Background(), timeout)
+}
+
+// PopContext behaves like Pop, returning the context's error if it is done
+// before a message arrives.
+func (mq *MemoryQueue) PopContext(ctx context.Context, timeout int) (string, error) {
+	messages, err := mq.pop(ctx, 1, timeout)
+	if err != nil {
+		return "", err
+	}
+	return messages[0], nil
+}
+
+// PopBatch will wait like Pop for the first message, then remove up to max
+// messages in total without waiting further.  ErrTimeout is returned if no
+// message arrived before the timeout.
+func (mq *MemoryQueue) PopBatch(max int, timeout int) ([]string, error) {
+	return mq.pop(context.Background(), max, timeout)
+}
+
+// PopMessage will perform a blocking pop from the queue and decode the
+// message.  Values pushed with plain Push are returned as the payload of a
+// message with no metadata.
+func (mq *MemoryQueue) PopMessage(timeout int) (*Message, error) {
+	value, err := mq.Pop(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessage(value)
+}
+
+// Length will return the number of messages on the queue.
+func (mq *MemoryQueue) Length() (int, error) {
+	return mq.LengthContext(context.Background())
+}
+
+// LengthContext behaves like Length, returning the context's error if it is
+// already done.
+func (mq *MemoryQueue) LengthContext(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	return len(mq.messages), nil
+}
+
+// pop waits for the queue to hold a message, then removes up to max
+// messages from its front.
+func (mq *MemoryQueue) pop(ctx context.Context, max int, timeout int) ([]string, error) {
+	if timeout < 0 {
+		return nil, errNegativeTimeout
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if max < 1 {
+		max = 1
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		mq.mu.Lock()
+		if n := len(mq.messages); n > 0 {
+			if n > max {
+				n = max
+			}
+			messages := make([]string, n)
+			copy(messages, mq.messages)
+			mq.messages = mq.messages[n:]
+			mq.mu.Unlock()
+			return messages, nil
+		}
+		if mq.changed == nil {
+			mq.changed = make(chan struct{})
+		}
+		changed := mq.changed
+		mq.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// testQ checks the FIFO and timeout semantics every Q implementation shares.
+// The queue must start empty.
+func testQ(t *testing.T, q Q) {
+	if l, err := q.Length(); l != 0 || err != nil {
+		t.Fatal("Expected an empty queue, got: ", l, err)
+	}
+
+	q.Push("a")
+	q.PushBatch([]string{"b", "c"})
+	q.PushContext(context.Background(), "d")
+	q.PushMessage(NewMessage("e"))
+	if l, err := q.LengthContext(context.Background()); l != 5 || err != nil {
+		t.Error("Expected length 5 but got: ", l, err)
+	}
+
+	if value, err := q.Pop(1); value != "a" || err != nil {
+		t.Error("Expected a but got: ", value, err)
+	}
+	if values, err := q.PopBatch(2, 1); len(values) != 2 || values[0] != "b" || values[1] != "c" || err != nil {
+		t.Error("Expected [b c] but got: ", values, err)
+	}
+	if value, err := q.PopContext(context.Background(), 1); value != "d" || err != nil {
+		t.Error("Expected d but got: ", value, err)
+	}
+	if m, err := q.PopMessage(1); err != nil || m.Payload != "e" || m.ID == "" {
+		t.Error("Expected message e but got: ", m, err)
+	}
+
+	start := time.Now()
+	if value, err := q.Pop(1); value != "" || err != ErrTimeout {
+		t.Error("Expected timeout but got: ", value, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Error("Expected to wait for the timeout, took: ", elapsed)
+	}
+	if values, err := q.PopBatch(10, 1); len(values) != 0 || err != ErrTimeout {
+		t.Error("Expected timeout but got: ", values, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.PopContext(ctx, 0); err != context.Canceled {
+		t.Error("Expected the cancelled context's error, got: ", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Push("f")
+	}()
+	if value, err := q.Pop(0); value != "f" || err != nil {
+		t.Error("Expected the push to wake the pop, got: ", value, err)
+	}
+}
+
+func TestQImplementations(t *testing.T) {
+	t.Run("Queue", func(t *testing.T) {
+		pool := NewPool(startServer(t).Addr(), 2, 2, 240*time.Second)
+		defer pool.Close()
+		testQ(t, QueueConnect(pool, "rq_test_q"))
+	})
+	t.Run("MultiQueue", func(t *testing.T) {
+		pool := NewPool(startServer(t).Addr(), 2, 2, 240*time.Second)
+		defer pool.Close()
+		testQ(t, NewMultiQueue(map[string]*redis.Pool{"foo1": pool}, "rq_test_q"))
+	})
+	t.Run("MemoryQueue", func(t *testing.T) {
+		testQ(t, NewMemoryQueue())
+	})
+}
+
+func TestMemoryQueueZeroValue(t *testing.T) {
+	var q MemoryQueue
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.PushBatch([]string{"foo", "bar"})
+	}()
+	if values, err := q.PopBatch(0, 1); len(values) != 1 || values[0] != "foo" || err != nil {
+		t.Error("Expected a single value but got: ", values, err)
+	}
+	if _, err := q.Pop(-1); err == nil {
+		t.Error("Expected a negative timeout to be rejected")
+	}
+}
+
+func TestMemoryQueueContextDeadline(t *testing.T) {
+	q := NewMemoryQueue()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := q.PopContext(ctx, 0); err != context.DeadlineExceeded {
+		t.Error("Expected the deadline to end the pop, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the pop to end at the deadline, took: ", elapsed)
+	}
+	if err := q.PushContext(ctx, "foo"); err != context.DeadlineExceeded {
+		t.Error("Expected the expired context to reject the push, got: ", err)
+	}
+}
+
+func TestWorkerWithMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue()
+	handled := make(chan string, 2)
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		handled <- message
+		return nil
+	}, 2)
+	w.Start()
+	defer w.Shutdown(context.Background())
+
+	q.PushBatch([]string{"foo", "bar"})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the worker to handle both messages")
+		}
+	}
+}
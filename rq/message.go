@@ -0,0 +1,125 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// envelopePrefix marks a value as an encoded Message.  Values without it were
+// pushed by plain producers and are treated as a bare payload.
+const envelopePrefix = "\x00rq1:"
+
+// Message is a payload together with the metadata needed to trace it through
+// a queue.
+type Message struct {
+	ID         string            `json:"id"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+	Attempts   int               `json:"attempts,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Payload    string            `json:"payload"`
+}
+
+// NewMessage creates a message with a new random ID for the given payload.
+func NewMessage(payload string) *Message {
+	return &Message{
+		ID:         newID(),
+		EnqueuedAt: time.Now().UTC(),
+		Headers:    map[string]string{},
+		Payload:    payload,
+	}
+}
+
+// Encode returns the message framed as an envelope for storage on a queue.
+func (m *Message) Encode() string {
+	data, _ := json.Marshal(m)
+	return envelopePrefix + string(data)
+}
+
+// DecodeMessage decodes a value popped from a queue.  A value that is not
+// framed as an envelope is returned as the payload of a message with no
+// metadata.  A *DecodeError is returned for a malformed envelope.
+func DecodeMessage(value string) (*Message, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return &Message{Payload: value}, nil
+	}
+
+	m := &Message{}
+	if err := json.Unmarshal([]byte(value[len(envelopePrefix):]), m); err != nil {
+		return nil, &DecodeError{Message: value, Err: err}
+	}
+	return m, nil
+}
+
+// prepare assigns an ID and enqueue time to a message about to be pushed,
+// if it does not already have them.
+func (m *Message) prepare() {
+	if m.ID == "" {
+		m.ID = newID()
+	}
+	if m.EnqueuedAt.IsZero() {
+		m.EnqueuedAt = time.Now().UTC()
+	}
+}
+
+// PushMessage will push the message onto the queue as an envelope, assigning
+// an ID and enqueue time if they are not set.
+func (queue *Queue) PushMessage(m *Message) error {
+	m.prepare()
+	return queue.Push(m.Encode())
+}
+
+// PopMessage will perform a blocking pop from the queue and decode the
+// message.  Values pushed with plain Push are returned as the payload of a
+// message with no metadata.
+func (queue *Queue) PopMessage(timeout int) (*Message, error) {
+	value, err := queue.Pop(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessage(value)
+}
+
+// PushMessage will push the message onto one of the healthy queues as an
+// envelope, assigning an ID and enqueue time if they are not set.
+func (m *MultiQueue) PushMessage(msg *Message) error {
+	msg.prepare()
+	return m.Push(msg.Encode())
+}
+
+// PopMessage will perform a blocking pop from one of the healthy queues and
+// decode the message.  ErrTimeout is returned if no message arrived before
+// the timeout.
+func (m *MultiQueue) PopMessage(timeout int) (*Message, error) {
+	value, err := m.Pop(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessage(value)
+}
+
+// Message decodes the delivered value, setting its attempt count from the
+// delivery.
+func (d *Delivery) Message() (*Message, error) {
+	m, err := DecodeMessage(d.Value)
+	if err != nil {
+		return nil, err
+	}
+	m.Attempts = d.Attempts
+	return m, nil
+}
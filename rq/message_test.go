@@ -0,0 +1,117 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestQueuePushPopMessage(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_message")
+	deleteKey(pool, "rq_test_message")
+
+	m := &Message{Payload: "foo", Headers: map[string]string{"trace": "abc"}}
+	if err := q.PushMessage(m); err != nil {
+		t.Error("Error while pushing to Redis queue", err)
+	}
+	if m.ID == "" || m.EnqueuedAt.IsZero() {
+		t.Errorf("Expected ID and enqueue time to be assigned: %+v", m)
+	}
+
+	popped, err := q.PopMessage(1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if popped.ID != m.ID || popped.Payload != "foo" || popped.Headers["trace"] != "abc" || !popped.EnqueuedAt.Equal(m.EnqueuedAt) {
+		t.Errorf("Expected %+v but got: %+v", m, popped)
+	}
+}
+
+func TestQueuePopMessageLegacyValue(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_message_legacy")
+	deleteKey(pool, "rq_test_message_legacy")
+
+	q.Push(`{"payload":"not an envelope"}`)
+	popped, err := q.PopMessage(1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if popped.Payload != `{"payload":"not an envelope"}` || popped.ID != "" {
+		t.Errorf("Expected legacy value as payload, got: %+v", popped)
+	}
+}
+
+func TestDecodeMessageMalformedEnvelope(t *testing.T) {
+	_, err := DecodeMessage(envelopePrefix + "{")
+
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Error("Expected decode error, got: ", err)
+	}
+}
+
+func TestMultiQueuePushPopMessage(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_multi_message")
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool}, "rq_test_multi_message")
+	m := NewMessage("foo")
+	q.PushMessage(m)
+
+	popped, err := q.PopMessage(1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if popped.ID != m.ID || popped.Payload != "foo" {
+		t.Errorf("Expected %+v but got: %+v", m, popped)
+	}
+
+	if popped, err = q.PopMessage(1); popped != nil || err != ErrTimeout {
+		t.Error("Expected timeout error, got: ", popped, err)
+	}
+}
+
+func TestDeliveryMessageAttempts(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_message_delivery")
+	resetDeadLetterQueue(q, "worker1")
+
+	q.PushMessage(NewMessage("foo"))
+	d, _ := q.ReliablePop("worker1", 1)
+	d.Nack(true)
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	m, err := d.Message()
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if m.Payload != "foo" || m.Attempts != 2 {
+		t.Errorf("Expected second attempt of foo, got: %+v", m)
+	}
+	d.Ack()
+}
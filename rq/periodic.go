@@ -0,0 +1,69 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"sync"
+	"time"
+)
+
+// periodic runs a function at a fixed interval on a background goroutine
+// between calls to start and stop.
+type periodic struct {
+	mu   sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+}
+
+// start launches the goroutine.  It has no effect if already running.
+func (p *periodic) start(interval time.Duration, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.quit != nil {
+		return
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	p.quit, p.done = quit, done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the goroutine and waits for any in-progress run to finish.
+func (p *periodic) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.quit == nil {
+		return
+	}
+	close(p.quit)
+	<-p.done
+	p.quit, p.done = nil, nil
+}
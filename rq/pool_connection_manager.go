@@ -16,32 +16,363 @@
 package rq
 
 import (
-	"github.com/garyburd/redigo/redis"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
+// ConnectOptions describes how to connect to a Redis server.
+type ConnectOptions struct {
+	// Network is "tcp" or "unix".
+	Network string
+
+	// Address is the host and port for TCP, or the socket path for unix.
+	Address string
+
+	// Username and Password are sent with AUTH when Password is set.  A
+	// Username selects a Redis 6 ACL user.
+	Username string
+	Password string
+
+	// Database is selected after connecting when non-zero.
+	Database int
+
+	// TLSConfig, if set, is used to secure TCP connections.
+	TLSConfig *tls.Config
+
+	// ConnectTimeout, ReadTimeout and WriteTimeout bound connecting and
+	// each read and write.  There is no limit when zero.  The reply to a
+	// blocking command such as BRPOP is allowed its own timeout on top of
+	// the ReadTimeout, and no limit if it blocks forever.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+}
+
+// ParseConnectString parses a connect string in one of these forms:
+//
+//	host:port[/db]
+//	redis://[[username]:password@]host[:port][/db][?options]
+//	rediss://[[username]:password@]host[:port][/db][?options]
+//	unix://[[username]:password@]/path/to/socket[?options]
+//
+// rediss URLs connect with TLS.  The options are connect_timeout,
+// read_timeout and write_timeout, given as durations such as "500ms" or as a
+// number of seconds, db, and for rediss URLs tls_ca, tls_cert and tls_key,
+// naming PEM files holding the CA certificates and the client certificate
+// and key, tls_server_name and tls_insecure_skip_verify.
+func ParseConnectString(connectString string) (*ConnectOptions, error) {
+	if !strings.Contains(connectString, "://") {
+		return parseHostPort(connectString)
+	}
+
+	u, err := url.Parse(connectString)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &ConnectOptions{}
+	switch u.Scheme {
+	case "redis", "rediss":
+		options.Network = "tcp"
+		options.Address = u.Host
+		if u.Port() == "" {
+			options.Address = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			if options.Database, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("Invalid database in connect string: %s", db)
+			}
+		}
+	case "unix":
+		options.Network = "unix"
+		options.Address = u.Path
+	default:
+		return nil, fmt.Errorf("Unsupported connect string scheme: %s", u.Scheme)
+	}
+
+	if u.User != nil {
+		options.Username = u.User.Username()
+		options.Password, _ = u.User.Password()
+	}
+
+	if err = options.parseQuery(u.Query(), u.Scheme == "rediss", u.Hostname()); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func parseHostPort(connectString string) (*ConnectOptions, error) {
+	options := &ConnectOptions{Network: "tcp"}
+	urlParts := strings.SplitN(connectString, "/", 2)
+	options.Address = urlParts[0]
+	if len(urlParts) == 2 {
+		var err error
+		if options.Database, err = strconv.Atoi(urlParts[1]); err != nil {
+			return nil, fmt.Errorf("Invalid database in connect string: %s", urlParts[1])
+		}
+	}
+	return options, nil
+}
+
+func (o *ConnectOptions) parseQuery(query url.Values, secure bool, host string) (err error) {
+	timeouts := map[string]*time.Duration{
+		"connect_timeout": &o.ConnectTimeout,
+		"read_timeout":    &o.ReadTimeout,
+		"write_timeout":   &o.WriteTimeout,
+	}
+	for name, timeout := range timeouts {
+		if value := query.Get(name); value != "" {
+			if *timeout, err = parseTimeout(value); err != nil {
+				return fmt.Errorf("Invalid %s in connect string: %s", name, value)
+			}
+		}
+	}
+
+	if db := query.Get("db"); db != "" {
+		if o.Database, err = strconv.Atoi(db); err != nil {
+			return fmt.Errorf("Invalid database in connect string: %s", db)
+		}
+	}
+
+	if !secure {
+		return nil
+	}
+	o.TLSConfig = &tls.Config{ServerName: host}
+	if serverName := query.Get("tls_server_name"); serverName != "" {
+		o.TLSConfig.ServerName = serverName
+	}
+	if skip := query.Get("tls_insecure_skip_verify"); skip != "" {
+		if o.TLSConfig.InsecureSkipVerify, err = strconv.ParseBool(skip); err != nil {
+			return fmt.Errorf("Invalid tls_insecure_skip_verify in connect string: %s", skip)
+		}
+	}
+	if ca := query.Get("tls_ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return err
+		}
+		o.TLSConfig.RootCAs = x509.NewCertPool()
+		if !o.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in tls_ca file: %s", ca)
+		}
+	}
+	if cert, key := query.Get("tls_cert"), query.Get("tls_key"); cert != "" || key != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return err
+		}
+		o.TLSConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return nil
+}
+
+// parseTimeout parses a duration such as "500ms", or a number of seconds.
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Dial connects to the server, authenticating and selecting the database as
+// needed.  The connection is closed and an error returned if AUTH or SELECT
+// fails.
+func (o *ConnectOptions) Dial() (redis.Conn, error) {
+	dialer := net.Dialer{Timeout: o.ConnectTimeout}
+	netConn, err := dialer.Dial(o.Network, o.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.TLSConfig != nil {
+		tlsConn := tls.Client(netConn, o.TLSConfig)
+		if o.ConnectTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(o.ConnectTimeout))
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	c := &timeoutConn{Conn: redis.NewConn(netConn, 0, o.WriteTimeout), netConn: netConn, readTimeout: o.ReadTimeout}
+	if o.Password != "" {
+		if o.Username != "" {
+			_, err = c.Do("AUTH", o.Username, o.Password)
+		} else {
+			_, err = c.Do("AUTH", o.Password)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if o.Database != 0 {
+		if _, err = c.Do("SELECT", o.Database); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// blockingCommands are the commands whose last argument is the number of
+// seconds they may block before replying.
+var blockingCommands = map[string]bool{
+	"BLMOVE": true, "BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true, "BZPOPMAX": true, "BZPOPMIN": true,
+}
+
+// blockingWait returns how long the command may block before replying, or
+// a negative duration if it may block forever.
+func blockingWait(cmd string, args []interface{}) time.Duration {
+	if !blockingCommands[strings.ToUpper(cmd)] || len(args) == 0 {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(fmt.Sprint(args[len(args)-1]), 64)
+	if err != nil {
+		return 0
+	}
+	if seconds == 0 {
+		return -1
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// timeoutConn applies the read timeout to a connection itself, so that the
+// deadline for the reply to a blocking command can be extended by the time
+// the command may block, and shortened to the deadline of a context.
+type timeoutConn struct {
+	redis.Conn
+	netConn     net.Conn
+	readTimeout time.Duration
+
+	// pending holds the blocking wait of each command sent whose reply
+	// has not been received.
+	pending []time.Duration
+
+	// ctxDeadline, if set, is the deadline of the context a command is
+	// being run under by doContext.
+	ctxDeadline time.Time
+}
+
+func (c *timeoutConn) Send(cmd string, args ...interface{}) error {
+	err := c.Conn.Send(cmd, args...)
+	if err == nil {
+		c.pending = append(c.pending, blockingWait(cmd, args))
+	}
+	return err
+}
+
+func (c *timeoutConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if isConnProbe(cmd, args) {
+		return c, nil
+	}
+
+	waits := c.pending
+	if cmd != "" {
+		waits = append(waits, blockingWait(cmd, args))
+	}
+	c.pending = nil
+	c.setReadDeadline(waits...)
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *timeoutConn) Receive() (interface{}, error) {
+	var wait time.Duration
+	if len(c.pending) > 0 {
+		wait, c.pending = c.pending[0], c.pending[1:]
+	}
+	c.setReadDeadline(wait)
+	return c.Conn.Receive()
+}
+
+// doContext runs the command, closing the connection to interrupt it if the
+// context is done before the reply arrives, and giving up reading at the
+// context's deadline.  A connection that was interrupted reports an error
+// from Err, so a pool discards it.
+func (c *timeoutConn) doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	c.ctxDeadline = deadline
+	defer func() { c.ctxDeadline = time.Time{} }()
+
+	stop := context.AfterFunc(ctx, func() { c.netConn.Close() })
+	defer stop()
+
+	reply, err := c.Do(cmd, args...)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if hasDeadline && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	return reply, err
+}
+
+// setReadDeadline allows the read timeout plus the longest of the waits for
+// the replies to be read, with no deadline if any of them may block
+// forever, and no later than the deadline of the context a command is run
+// under.
+func (c *timeoutConn) setReadDeadline(waits ...time.Duration) {
+	var deadline time.Time
+	if c.readTimeout > 0 {
+		var longest time.Duration
+		for _, wait := range waits {
+			if wait < 0 {
+				longest = -1
+				break
+			}
+			if wait > longest {
+				longest = wait
+			}
+		}
+		if longest >= 0 {
+			deadline = time.Now().Add(c.readTimeout + longest)
+		}
+	}
+	if !c.ctxDeadline.IsZero() && (deadline.IsZero() || c.ctxDeadline.Before(deadline)) {
+		deadline = c.ctxDeadline
+	}
+	c.netConn.SetReadDeadline(deadline)
+}
+
+// NewPool creates a pool of connections to the server described by the
+// connect string, in any of the forms accepted by ParseConnectString.  An
+// invalid connect string is reported by every attempt to get a connection.
 func NewPool(connectString string, maxIdle int, maxActive int, idleTime time.Duration) *redis.Pool {
+	options, err := ParseConnectString(connectString)
+	if err != nil {
+		pool := NewPoolWithOptions(&ConnectOptions{}, maxIdle, maxActive, idleTime)
+		pool.Dial = func() (redis.Conn, error) {
+			return nil, err
+		}
+		return pool
+	}
+	return NewPoolWithOptions(options, maxIdle, maxActive, idleTime)
+}
+
+// NewPoolWithOptions creates a pool of connections to the server described
+// by the options.
+func NewPoolWithOptions(options *ConnectOptions, maxIdle int, maxActive int, idleTime time.Duration) *redis.Pool {
 	pool := redis.Pool{
 		MaxIdle:     maxIdle,
 		MaxActive:   maxActive,
 		IdleTimeout: idleTime,
 		Wait:        true,
-		Dial: func() (redis.Conn, error) {
-			urlParts := strings.Split(connectString, "/")
-			c, err := redis.Dial("tcp", urlParts[0])
-			if err != nil {
-				return nil, err
-			}
-
-			if len(urlParts) == 2 {
-				selectErr := c.Send("SELECT", urlParts[1])
-				if selectErr != nil {
-					return nil, selectErr
-				}
-			}
-			return c, err
-		},
+		Dial:        options.Dial,
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
@@ -0,0 +1,122 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// PriorityQueue is a queue with a fixed number of priority levels, each
+// backed by its own Redis list named <key>:p<level>.  Level 0 is the highest
+// priority.
+type PriorityQueue struct {
+	pooledConnection *redis.Pool
+	key              string
+	levels           int
+}
+
+// NewPriorityQueue creates a queue corresponding to the given key with the
+// given number of priority levels.
+func NewPriorityQueue(pooledConnection *redis.Pool, key string, levels int) *PriorityQueue {
+	if levels < 1 {
+		levels = 1
+	}
+	return &PriorityQueue{pooledConnection: pooledConnection, key: key, levels: levels}
+}
+
+// Levels returns the number of priority levels of the queue.
+func (pq *PriorityQueue) Levels() int {
+	return pq.levels
+}
+
+// PushPriority will perform a left-push of the value onto the list for the
+// given priority level.  An error will be returned if the level is out of
+// range or the operation failed.
+func (pq *PriorityQueue) PushPriority(value string, level int) error {
+	if level < 0 || level >= pq.levels {
+		return ErrInvalidPriority
+	}
+
+	c := pq.pooledConnection.Get()
+	defer c.Close()
+
+	_, err := c.Do("LPUSH", pq.levelKey(level), value)
+	return err
+}
+
+// Push will push the value at the lowest priority level.
+func (pq *PriorityQueue) Push(value string) error {
+	return pq.PushPriority(value, pq.levels-1)
+}
+
+// Pop will perform a blocking right-pop from the highest priority level that
+// has a message available.  ErrTimeout is returned if no message arrived
+// before the timeout, and an error will be returned if the operation failed.
+func (pq *PriorityQueue) Pop(timeout int) (string, error) {
+	c := pq.pooledConnection.Get()
+	defer c.Close()
+
+	args := make([]interface{}, 0, pq.levels+1)
+	for level := 0; level < pq.levels; level++ {
+		args = append(args, pq.levelKey(level))
+	}
+	args = append(args, timeout)
+
+	rep, err := redis.Strings(c.Do("BRPOP", args...))
+	if err == nil {
+		return rep[1], nil
+	} else {
+		return "", timeoutOrError(err)
+	}
+}
+
+// Length will return the number of items across all priority levels.
+func (pq *PriorityQueue) Length() (int, error) {
+	c := pq.pooledConnection.Get()
+	defer c.Close()
+
+	for level := 0; level < pq.levels; level++ {
+		c.Send("LLEN", pq.levelKey(level))
+	}
+	lengths, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, l := range lengths {
+		total = total + l
+	}
+	return total, nil
+}
+
+// LevelLength will return the number of items at the given priority level.
+func (pq *PriorityQueue) LevelLength(level int) (int, error) {
+	if level < 0 || level >= pq.levels {
+		return 0, ErrInvalidPriority
+	}
+
+	c := pq.pooledConnection.Get()
+	defer c.Close()
+
+	return redis.Int(c.Do("LLEN", pq.levelKey(level)))
+}
+
+func (pq *PriorityQueue) levelKey(level int) string {
+	return pq.key + ":p" + strconv.Itoa(level)
+}
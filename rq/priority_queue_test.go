@@ -0,0 +1,80 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import "testing"
+
+func resetPriorityQueue(q *PriorityQueue) {
+	for level := 0; level < q.Levels(); level++ {
+		deleteKey(q.pooledConnection, q.levelKey(level))
+	}
+}
+
+func TestPriorityQueuePopHighestFirst(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := NewPriorityQueue(pool, "rq_test_priority", 3)
+	resetPriorityQueue(q)
+
+	q.Push("bulk")
+	q.PushPriority("normal1", 1)
+	q.PushPriority("urgent", 0)
+	q.PushPriority("normal2", 1)
+
+	l, err := q.Length()
+	if l != 4 {
+		t.Error("Expected length to be 4, was: ", l)
+	}
+	if err != nil {
+		t.Error("Error while getting length of Redis queue", err)
+	}
+	if l, _ = q.LevelLength(1); l != 2 {
+		t.Error("Expected level 1 length to be 2, was: ", l)
+	}
+
+	for _, expected := range []string{"urgent", "normal1", "normal2", "bulk"} {
+		value, err := q.Pop(1)
+		if value != expected {
+			t.Errorf("Expected %s but got: %s", expected, value)
+		}
+		if err != nil {
+			t.Error("Unexpected error: ", err)
+		}
+	}
+}
+
+func TestPriorityQueueInvalidLevel(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := NewPriorityQueue(pool, "rq_test_priority_invalid", 2)
+
+	if err := q.PushPriority("foo", 2); err != ErrInvalidPriority {
+		t.Error("Expected invalid priority error, got: ", err)
+	}
+	if err := q.PushPriority("foo", -1); err != ErrInvalidPriority {
+		t.Error("Expected invalid priority error, got: ", err)
+	}
+}
+
+func BenchmarkPriorityQueuePushPop(b *testing.B) {
+	pool := createPool()
+	defer pool.Close()
+	q := NewPriorityQueue(pool, "rq_test_priority_pushpop_bench", 3)
+	for i := 0; i < b.N; i++ {
+		q.PushPriority("foo", i%3)
+		q.Pop(1)
+	}
+}
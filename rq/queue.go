@@ -0,0 +1,43 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import "context"
+
+// Q is the set of operations shared by Queue, MultiQueue and MemoryQueue,
+// so that code can be written against any of them and tested with a
+// MemoryQueue or a mock.  Pop blocks for up to timeout seconds, or forever
+// when the timeout is zero, and returns ErrTimeout if no message arrived.
+type Q interface {
+	Push(value string) error
+	PushContext(ctx context.Context, value string) error
+	PushBatch(values []string) error
+	PushMessage(m *Message) error
+
+	Pop(timeout int) (string, error)
+	PopContext(ctx context.Context, timeout int) (string, error)
+	PopBatch(max int, timeout int) ([]string, error)
+	PopMessage(timeout int) (*Message, error)
+
+	Length() (int, error)
+	LengthContext(ctx context.Context) (int, error)
+}
+
+var (
+	_ Q = (*Queue)(nil)
+	_ Q = (*MultiQueue)(nil)
+	_ Q = (*MemoryQueue)(nil)
+)
@@ -0,0 +1,160 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Reaper periodically calls RequeueExpired on a queue so that messages held
+// by consumers that crashed or stalled are retried without intervention.
+type Reaper struct {
+	queue    *Queue
+	interval time.Duration
+
+	// ErrorHandler, if set, is called with any error returned by
+	// RequeueExpired.  It must be set before the reaper is started.
+	ErrorHandler func(error)
+
+	runner periodic
+}
+
+// NewReaper creates a Reaper for the queue that runs at the given interval
+// once started.
+func NewReaper(queue *Queue, interval time.Duration) *Reaper {
+	return &Reaper{queue: queue, interval: interval}
+}
+
+// Start begins reaping in the background.  Calling Start on a running
+// reaper has no effect.
+func (r *Reaper) Start() {
+	r.runner.start(r.interval, r.reap)
+}
+
+// Stop stops the reaper, waiting for any pass in progress to complete.
+func (r *Reaper) Stop() {
+	r.runner.stop()
+}
+
+func (r *Reaper) reap() {
+	if _, err := r.queue.RequeueExpired(); err != nil && r.ErrorHandler != nil {
+		r.ErrorHandler(err)
+	}
+}
+
+// RequeueExpired returns every delivery whose visibility timeout has passed
+// to the queue, so that it will be the next message popped, and returns the
+// number of expired messages.  Messages that have used up the queue's
+// MaxAttempts are moved to the dead-letter list instead.  Consumers are
+// registered before they pop, so messages found on a processing list
+// without a deadline, left by a consumer that failed straight after popping,
+// are also found and given one.
+func (queue *Queue) RequeueExpired() (requeued int, err error) {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	var consumers []string
+	if consumers, err = redis.Strings(c.Do("SMEMBERS", queue.consumersKey())); err != nil {
+		return
+	}
+
+	for _, consumer := range consumers {
+		var n int
+		n, err = queue.requeueExpired(c, queue.processingKey(consumer))
+		requeued = requeued + n
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (queue *Queue) requeueExpired(c redis.Conn, processingKey string) (int, error) {
+	deadlines := deadlinesKey(processingKey)
+	for {
+		if _, err := c.Do("WATCH", processingKey, deadlines); err != nil {
+			return 0, err
+		}
+
+		values, err := redis.Strings(c.Do("LRANGE", processingKey, 0, -1))
+		if err != nil {
+			return 0, err
+		}
+		tracked, err := redis.Strings(c.Do("ZRANGE", deadlines, 0, -1))
+		if err != nil {
+			return 0, err
+		}
+		expired, err := redis.Strings(c.Do("ZRANGEBYSCORE", deadlines, "-inf", unixMillis(time.Now())))
+		if err != nil {
+			return 0, err
+		}
+
+		orphans := []string{}
+		for _, value := range values {
+			if countString(tracked, value) == 0 && countString(orphans, value) == 0 {
+				orphans = append(orphans, value)
+			}
+		}
+		if len(expired) == 0 && len(orphans) == 0 {
+			c.Do("UNWATCH")
+			return 0, nil
+		}
+
+		attempts := make([]int, len(expired))
+		lastErrors := make([]string, len(expired))
+		for i, value := range expired {
+			if attempts[i], err = redis.Int(c.Do("HGET", queue.attemptsKey(), historyField(value))); err != nil && err != redis.ErrNil {
+				return 0, err
+			}
+			if lastErrors[i], err = redis.String(c.Do("HGET", queue.errorsKey(), historyField(value))); err != nil && err != redis.ErrNil {
+				return 0, err
+			}
+		}
+
+		requeued := 0
+		c.Send("MULTI")
+		for i, value := range expired {
+			c.Send("ZREM", deadlines, value)
+			copies := countString(values, value)
+			if copies == 0 {
+				continue
+			}
+			c.Send("LREM", processingKey, 0, value)
+			for j := 0; j < copies; j++ {
+				if queue.exhausted(attempts[i]) {
+					queue.sendDeadLetter(c, value, DeadReasonExpired, lastErrors[i], attempts[i])
+				} else {
+					c.Send("RPUSH", queue.key, value)
+				}
+			}
+			requeued = requeued + copies
+		}
+		for _, value := range orphans {
+			c.Send("ZADD", deadlines, queue.deadline(), value)
+		}
+
+		reply, err := c.Do("EXEC")
+		if err != nil {
+			return 0, err
+		}
+		if reply != nil {
+			return requeued, nil
+		}
+		// a delivery was settled while the lists were being watched, try again
+	}
+}
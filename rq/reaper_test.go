@@ -0,0 +1,160 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueRequeueExpired(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_requeue_expired")
+	q.VisibilityTimeout = 10 * time.Millisecond
+	resetReliableQueue(pool, q, "worker1")
+
+	q.Push("foo")
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	if n, err := q.RequeueExpired(); n != 0 || err != nil {
+		t.Error("Expected nothing requeued before the timeout, got: ", n, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n, err := q.RequeueExpired(); n != 1 || err != nil {
+		t.Error("Expected 1 message requeued, got: ", n, err)
+	}
+	if l := listLength(pool, q.processingKey("worker1")); l != 0 {
+		t.Error("Expected empty processing list, was: ", l)
+	}
+	if err = d.Ack(); err != ErrDeliveryNotFound {
+		t.Error("Expected delivery not found error, got: ", err)
+	}
+
+	value, err := q.Pop(1)
+	if value != "foo" {
+		t.Error("Expected foo but got: ", value)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestQueueRequeueExpiredSkipsAcknowledged(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_requeue_acked")
+	q.VisibilityTimeout = 10 * time.Millisecond
+	resetReliableQueue(pool, q, "worker1")
+
+	q.Push("foo")
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	d.Ack()
+
+	time.Sleep(20 * time.Millisecond)
+	if n, err := q.RequeueExpired(); n != 0 || err != nil {
+		t.Error("Expected nothing requeued, got: ", n, err)
+	}
+	if l, _ := q.Length(); l != 0 {
+		t.Error("Expected empty queue, was: ", l)
+	}
+}
+
+func TestQueueRequeueExpiredAdoptsUntrackedMessages(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_requeue_orphan")
+	q.VisibilityTimeout = 10 * time.Millisecond
+	resetReliableQueue(pool, q, "worker1")
+
+	// simulate a consumer that died between BRPOPLPUSH and recording the deadline
+	conn := pool.Get()
+	conn.Do("LPUSH", q.processingKey("worker1"), "foo")
+	conn.Do("SADD", q.consumersKey(), "worker1")
+	conn.Close()
+
+	if n, err := q.RequeueExpired(); n != 0 || err != nil {
+		t.Error("Expected nothing requeued on first pass, got: ", n, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n, err := q.RequeueExpired(); n != 1 || err != nil {
+		t.Error("Expected 1 message requeued, got: ", n, err)
+	}
+}
+
+func TestQueueRequeueExpiredFindsMessagesOfConsumersThatFailedAfterPopping(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_requeue_unregistered")
+	q.VisibilityTimeout = 10 * time.Millisecond
+	resetReliableQueue(pool, q, "worker1")
+
+	// the consumer is registered by its first pop, even one that times out
+	if _, err := q.ReliablePop("worker1", 1); err != ErrTimeout {
+		t.Fatal("Expected timeout, got: ", err)
+	}
+
+	// simulate the consumer dying straight after its next BRPOPLPUSH
+	q.Push("foo")
+	conn := pool.Get()
+	conn.Do("BRPOPLPUSH", q.key, q.processingKey("worker1"), 1)
+	conn.Close()
+
+	if n, err := q.RequeueExpired(); n != 0 || err != nil {
+		t.Error("Expected nothing requeued on first pass, got: ", n, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n, err := q.RequeueExpired(); n != 1 || err != nil {
+		t.Error("Expected 1 message requeued, got: ", n, err)
+	}
+}
+
+func TestReaperStartStop(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_reaper")
+	q.VisibilityTimeout = 10 * time.Millisecond
+	resetReliableQueue(pool, q, "worker1")
+
+	q.Push("foo")
+	if _, err := q.ReliablePop("worker1", 1); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	// the test pools only allow a single connection, so the reaper needs its own
+	reaperPool := createPool()
+	defer reaperPool.Close()
+	reaperQueue := QueueConnect(reaperPool, "rq_test_reaper")
+
+	r := NewReaper(reaperQueue, 5*time.Millisecond)
+	r.Start()
+	defer r.Stop()
+
+	value, err := q.Pop(1)
+	if value != "foo" {
+		t.Error("Expected reaped foo but got: ", value)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
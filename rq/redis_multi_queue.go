@@ -16,83 +16,468 @@
 package rq
 
 import (
-	"errors"
-	"fmt"
-	"math/rand"
+	"context"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 type MultiQueue struct {
-	mu        sync.Mutex
 	queueName string
 	queues    []*ErrorDecayQueue
+	next      uint32
+	selector  Selector
+	ring      *hashRing
+
+	replicas    int
+	writeQuorum int
+	claimTTL    time.Duration
+
+	pushRetries int
+	pushBackoff time.Duration
+
+	healthChecker periodic
+	checkCtx      context.Context
+	stopChecks    context.CancelFunc
+
+	eventsMu     sync.Mutex
+	healthEvents chan HealthEvent
+	closed       bool
 }
 
-var noQueuesAvailableError = errors.New("No queues available")
+// HealthEvent records a server behind a MultiQueue moving between healthy
+// and unhealthy.
+type HealthEvent struct {
+	Server      string
+	Healthy     bool
+	ErrorRating float64
+	Time        time.Time
+}
+
+// healthEventBuffer is the number of events HealthEvents holds for a slow
+// reader before further events are dropped.
+const healthEventBuffer = 64
+
+// popSweepWait is the number of seconds Pop blocks on a single queue between
+// sweeps of every healthy queue.
+const popSweepWait = 1
+
+// MultiQueueOptions configures a MultiQueue created with
+// NewMultiQueueWithOptions.
+type MultiQueueOptions struct {
+	// ErrorDecay tunes the circuit breaker kept for each server.
+	ErrorDecay ErrorDecayOptions
+
+	// HealthCheckInterval, if set, is how often every server is probed in
+	// the background so that failed servers are detected, and recovered
+	// servers returned to service, without waiting for traffic.  Close must
+	// be called to stop the health checker.
+	HealthCheckInterval time.Duration
+
+	// Selector chooses the queue each push is sent to.  The RandomSelector
+	// is used when nil.
+	Selector Selector
+
+	// Replicas, if greater than one, is the number of servers each value
+	// given to Push, PushContext, PushBatch or PushMessage is written to, so
+	// that it survives the loss of a server.  Replicated values are wrapped
+	// in an envelope with a message ID, and Pop delivers only the first copy
+	// of each.  PushWithKey is not replicated.
+	Replicas int
+
+	// WriteQuorum is the number of servers that must acknowledge a
+	// replicated push for it to succeed.  A majority of the Replicas is
+	// required when zero.
+	WriteQuorum int
+
+	// ClaimTTL is how long a delivered replicated message is remembered, so
+	// copies popped later than this are delivered again.  The
+	// DefaultClaimTTL is used when zero.
+	ClaimTTL time.Duration
+
+	// PushRetries is the number of times a failed push is retried, each on
+	// a healthy server that has not yet been tried.  Pushes are not retried
+	// when zero.
+	PushRetries int
+
+	// PushBackoff is how long to wait before the first retry of a failed
+	// push.  The wait doubles with each further retry.
+	PushBackoff time.Duration
+}
 
 func NewMultiQueue(pools map[string]*redis.Pool, queueName string) *MultiQueue {
+	return NewMultiQueueWithOptions(pools, queueName, MultiQueueOptions{})
+}
+
+// NewMultiQueueWithOptions creates a MultiQueue across the given pools, keyed
+// by server name, using the supplied options.
+func NewMultiQueueWithOptions(pools map[string]*redis.Pool, queueName string, options MultiQueueOptions) *MultiQueue {
 	queues := []*ErrorDecayQueue{}
 	for server, pooledConnection := range pools {
-		queue := NewErrorDecayQueue(server, queueName, pooledConnection)
+		queue := NewErrorDecayQueueWithOptions(server, queueName, pooledConnection, options.ErrorDecay)
 		queues = append(queues, queue)
 	}
-	return &MultiQueue{queueName: queueName, queues: queues}
+	selector := options.Selector
+	if selector == nil {
+		selector = RandomSelector
+	}
+	m := &MultiQueue{queueName: queueName, queues: queues, selector: selector, ring: newHashRing(queues)}
+	m.checkCtx, m.stopChecks = context.WithCancel(context.Background())
+
+	m.replicas = options.Replicas
+	if m.replicas > len(queues) {
+		m.replicas = len(queues)
+	}
+	m.writeQuorum = options.WriteQuorum
+	if m.writeQuorum <= 0 {
+		m.writeQuorum = m.replicas/2 + 1
+	} else if m.writeQuorum > m.replicas {
+		m.writeQuorum = m.replicas
+	}
+	m.pushRetries, m.pushBackoff = options.PushRetries, options.PushBackoff
+	m.claimTTL = options.ClaimTTL
+	if m.claimTTL <= 0 {
+		m.claimTTL = DefaultClaimTTL
+	}
+	if options.HealthCheckInterval > 0 {
+		m.healthChecker.start(options.HealthCheckInterval, func() { m.checkHealth(m.checkCtx) })
+	}
+	return m
+}
+
+// Close stops the background health checker, if one was started, and
+// closes the HealthEvents channel.  Probes still waiting for a reply are
+// abandoned rather than waited for.
+func (m *MultiQueue) Close() error {
+	m.stopChecks()
+	m.healthChecker.stop()
+
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		if m.healthEvents != nil {
+			close(m.healthEvents)
+		}
+	}
+	return nil
+}
+
+// OnHealthChange registers a function to be called whenever a server moves
+// between healthy and unhealthy, with the new state and error rating.  It
+// is called synchronously on the goroutine that caused the change, so it
+// should return quickly.
+func (m *MultiQueue) OnHealthChange(fn func(server string, healthy bool, rating float64)) {
+	for _, q := range m.queues {
+		q.OnHealthChange(fn)
+	}
+}
+
+// HealthEvents returns a channel on which every change in the health of a
+// server is delivered.  Each call returns the same channel, which is closed
+// by Close.  Events are dropped rather than blocking queue operations if the
+// channel's buffer is full.
+func (m *MultiQueue) HealthEvents() <-chan HealthEvent {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+
+	if m.healthEvents == nil {
+		m.healthEvents = make(chan HealthEvent, healthEventBuffer)
+		if m.closed {
+			close(m.healthEvents)
+		} else {
+			m.OnHealthChange(m.sendHealthEvent)
+		}
+	}
+	return m.healthEvents
+}
+
+func (m *MultiQueue) sendHealthEvent(server string, healthy bool, rating float64) {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+
+	if m.closed {
+		return
+	}
+	select {
+	case m.healthEvents <- HealthEvent{Server: server, Healthy: healthy, ErrorRating: rating, Time: time.Now()}:
+	default:
+	}
+}
+
+// CheckHealth probes every server concurrently and waits for the probes to
+// complete, each taking no longer than the ProbeTimeout.  It is called
+// periodically when a HealthCheckInterval is set.
+func (m *MultiQueue) CheckHealth() {
+	m.checkHealth(context.Background())
+}
+
+// checkHealth behaves like CheckHealth, abandoning the probes when the
+// context is cancelled.
+func (m *MultiQueue) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, q := range m.queues {
+		wg.Add(1)
+		go func(q *ErrorDecayQueue) {
+			defer wg.Done()
+			q.probeHealth(ctx)
+		}(q)
+	}
+	wg.Wait()
+}
+
+// Status returns the health of every server, ordered by server name.
+func (m *MultiQueue) Status() []BackendStatus {
+	statuses := make([]BackendStatus, 0, len(m.queues))
+	for _, q := range m.queues {
+		statuses = append(statuses, q.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Server < statuses[j].Server })
+	return statuses
 }
 
 // Push will perform a left-push onto a Redis list/queue with the supplied
-// queueName and value.  An error will be returned if the operation failed.
-func (m *MultiQueue) Push(value string) (err error) {
+// queueName and value.  A *PushError will be returned if the operation
+// failed on every server attempted.
+func (m *MultiQueue) Push(value string) error {
+	return m.PushContext(context.Background(), value)
+}
+
+// PushContext behaves like Push, returning the context's error if it is done
+// before the push completes.  Cancellation is not recorded as an error
+// against the selected queue.
+func (m *MultiQueue) PushContext(ctx context.Context, value string) error {
+	if m.replicas > 1 {
+		return m.pushReplicated(ctx, value)
+	}
+	return m.push(ctx, []string{value})
+}
+
+// PushWithKey will perform a left-push of the value onto the Redis list/queue
+// that the partition key maps to by consistent hashing, so that values
+// pushed with the same key are popped in order while the server stays
+// healthy.  If the key's server is unhealthy the next healthy server on the
+// hash ring is used, and the key's own server is used if none are healthy.
+// An error will be returned if the operation failed.
+func (m *MultiQueue) PushWithKey(partitionKey string, value string) (err error) {
 	var q *ErrorDecayQueue
-	if q, err = m.SelectHealthyQueue(); err != nil {
+	if q, err = m.SelectQueueForKey(partitionKey); err != nil {
 		return
 	}
 
 	conn := q.pooledConnection.Get()
 	defer conn.Close()
 
-	if _, err = conn.Do("LPUSH", m.queueName, value); err != nil && err != redis.ErrNil {
-		previousErrorRating := q.errorRating
-		q.QueueError()
-		err = fmt.Errorf("Recorded error for queue: server=%s, queueName=%s, previous error rating=%f, new error rating=%f", q.server, q.queueName, previousErrorRating, q.errorRating)
+	if _, err = conn.Do("LPUSH", m.queueName, value); err != nil {
+		err = recordError(q, err)
 	}
 	return
 }
 
-// Pop will perform a blocking right-pop from a Redis list/queue with the supplied
-// queueName.  An error will be returned if the operation failed.
-func (m *MultiQueue) Pop(timeout int) (message string, err error) {
-	var q *ErrorDecayQueue
-	if q, err = m.SelectHealthyQueue(); err != nil {
+// SelectQueueForKey returns the first healthy queue on the hash ring at or
+// after the partition key, or the key's own queue if none are healthy.
+func (m *MultiQueue) SelectQueueForKey(partitionKey string) (*ErrorDecayQueue, error) {
+	queues := m.ring.queues(partitionKey)
+	if len(queues) == 0 {
+		return nil, ErrNoQueuesAvailable
+	}
+	for _, q := range queues {
+		if q.IsHealthy() {
+			return q, nil
+		}
+	}
+	return queues[0], nil
+}
+
+// PushBatch will perform a single variadic left-push of the values onto one
+// of the healthy Redis lists/queues.  An error will be returned if the
+// operation failed.
+func (m *MultiQueue) PushBatch(values []string) (err error) {
+	if len(values) == 0 {
 		return
 	}
+	if m.replicas > 1 {
+		for _, value := range values {
+			if err = m.pushReplicated(context.Background(), value); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	return m.push(context.Background(), values)
+}
+
+// Pop will return the next message from any of the healthy Redis
+// lists/queues with the supplied queueName, polling each of them in turn so
+// that no server is starved, and blocking for up to timeout seconds (forever
+// when zero) if they are all empty.  While no server is healthy it waits for
+// one to recover.  ErrTimeout is returned if no message arrived before the
+// timeout, ErrNoQueuesAvailable if no server recovered before it, and an
+// error will be returned if the operation failed.
+func (m *MultiQueue) Pop(timeout int) (string, error) {
+	return m.PopContext(context.Background(), timeout)
+}
+
+// PopContext behaves like Pop, giving up when the context is done.  The
+// timeout is shortened to the context's deadline, and a cancelled context
+// is noticed within a second, between sweeps of the queues.
+func (m *MultiQueue) PopContext(ctx context.Context, timeout int) (message string, err error) {
+	for {
+		if _, message, err = m.pop(ctx, timeout); err != nil {
+			return
+		}
+
+		var first bool
+		if message, first = m.claim(message); first {
+			return
+		}
+	}
+}
+
+// PopBatch will perform a blocking right-pop for the first message from any
+// of the healthy Redis lists/queues, then pipeline non-blocking right-pops
+// for up to max messages in total from the same list.  ErrTimeout is
+// returned if no message arrived before the timeout, and an error will be
+// returned if the operation failed.
+func (m *MultiQueue) PopBatch(max int, timeout int) (messages []string, err error) {
+	for {
+		var popped []string
+		if popped, err = m.popBatch(max, timeout); len(popped) == 0 {
+			return
+		}
+
+		for _, message := range popped {
+			if message, first := m.claim(message); first {
+				messages = append(messages, message)
+			}
+		}
+		if len(messages) > 0 || err != nil {
+			return
+		}
+	}
+}
+
+func (m *MultiQueue) popBatch(max int, timeout int) ([]string, error) {
+	q, message, err := m.pop(context.Background(), timeout)
+	if err != nil {
+		return nil, err
+	}
 
 	conn := q.pooledConnection.Get()
 	defer conn.Close()
 
-	var r []string
-	if r, err = redis.Strings(conn.Do("BRPOP", m.queueName, timeout)); err == nil {
-		if len(r) >= 2 {
-			message = r[1]
+	return popMore([]string{message}, conn, m.queueName, max)
+}
+
+// pop sweeps the healthy queues with non-blocking right-pops, starting from
+// a different queue on each call so that none is starved, and returns the
+// first message found along with the queue it came from.  When every queue
+// is empty it blocks on one of them for up to popSweepWait seconds before
+// sweeping again, until the timeout expires.  A timeout of zero waits
+// forever.  ErrTimeout is returned on timeout.  While no queue is healthy it
+// waits for one to recover, returning ErrNoQueuesAvailable if none has by
+// the timeout.
+func (m *MultiQueue) pop(ctx context.Context, timeout int) (q *ErrorDecayQueue, message string, err error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+
+	for {
+		queues := m.HealthyQueues()
+		if len(queues) == 0 {
+			if len(m.queues) == 0 {
+				return nil, "", ErrNoQueuesAvailable
+			}
+			if err = awaitRecovery(ctx, deadline); err != nil {
+				return nil, "", err
+			}
+			continue
 		}
-	} else {
-		if err == redis.ErrNil {
-			err = nil // clear out the error if it's just signaling no data was read
+		start := int(atomic.AddUint32(&m.next, 1) % uint32(len(queues)))
+
+		failures := 0
+		for i := range queues {
+			q = queues[(start+i)%len(queues)]
+			if message, err = redis.String(doContext(ctx, q.pooledConnection, "RPOP", m.queueName)); err == nil {
+				return
+			} else if err == ctx.Err() {
+				return nil, "", err
+			} else if err != redis.ErrNil {
+				err = recordError(q, err)
+				failures++
+			}
+		}
+		if failures == len(queues) {
+			return nil, "", err
+		}
+
+		wait := popSweepWait
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, "", ErrTimeout
+			}
+			if remaining < time.Duration(wait)*time.Second {
+				wait = int(math.Ceil(remaining.Seconds()))
+			}
+		}
+
+		q = queues[start]
+		var r []string
+		if r, err = redis.Strings(blockingDoContext(ctx, q.pooledConnection, contextTimeout(ctx, wait), "BRPOP", m.queueName)); err == nil {
+			return q, r[1], nil
+		} else if err == ctx.Err() {
+			return nil, "", err
+		} else if err != redis.ErrNil {
+			recordError(q, err)
 		}
 	}
-	return
+}
+
+// awaitRecovery waits for up to popSweepWait seconds before the health of
+// the queues is checked again, returning ErrNoQueuesAvailable if the
+// deadline has passed and the context's error if it is done first.
+func awaitRecovery(ctx context.Context, deadline time.Time) error {
+	wait := time.Duration(popSweepWait) * time.Second
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrNoQueuesAvailable
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // Length will return the number of items in the specified list/queue
-func (m *MultiQueue) Length() (total int, err error) {
+func (m *MultiQueue) Length() (int, error) {
+	return m.LengthContext(context.Background())
+}
+
+// LengthContext behaves like Length, returning the context's error if it is
+// done before every healthy queue has replied.
+func (m *MultiQueue) LengthContext(ctx context.Context) (total int, err error) {
 	total = 0
 	for _, q := range m.HealthyQueues() {
-		conn := q.pooledConnection.Get()
-		defer conn.Close()
-
 		var rep int
-		if rep, err = redis.Int(conn.Do("LLEN", m.queueName)); err != nil {
+		if rep, err = redis.Int(doContext(ctx, q.pooledConnection, "LLEN", m.queueName)); err != nil {
 			return
 		}
 		total = total + rep
@@ -101,9 +486,6 @@ func (m *MultiQueue) Length() (total int, err error) {
 }
 
 func (m *MultiQueue) HealthyQueues() (healthyQueues []*ErrorDecayQueue) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	healthyQueues = make([]*ErrorDecayQueue, 0)
 	for _, q := range m.queues {
 		if q.IsHealthy() {
@@ -114,20 +496,5 @@ func (m *MultiQueue) HealthyQueues() (healthyQueues []*ErrorDecayQueue) {
 }
 
 func (mq *MultiQueue) SelectHealthyQueue() (*ErrorDecayQueue, error) {
-	healthyQueues := mq.HealthyQueues()
-	numberOfHealthyQueues := len(healthyQueues)
-
-	index := 0
-	if numberOfHealthyQueues == 0 {
-		numberOfQueues := len(mq.queues)
-		if numberOfQueues == 0 {
-			return nil, noQueuesAvailableError
-		}
-		index = rand.Intn(numberOfQueues)
-
-		return mq.queues[index], nil
-	} else if numberOfHealthyQueues > 1 {
-		index = rand.Intn(numberOfHealthyQueues)
-	}
-	return healthyQueues[index], nil
+	return mq.selectQueue(nil)
 }
@@ -16,10 +16,14 @@
 package rq
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/skidder/redis-queue/rqtest"
 )
 
 func TestNewMultiQueueOneHostSuccessful(t *testing.T) {
@@ -138,6 +142,352 @@ func TestMultiQueueLengthSuccessful(t *testing.T) {
 	}
 }
 
+func TestMultiQueuePushPopBatch(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+
+	var e error
+	if e = deleteKey(pool, "rq_test_multi_batch"); e != nil {
+		t.Error("Unable to delete key in test setup")
+	}
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool}, "rq_test_multi_batch")
+	if err := q.PushBatch([]string{"foo", "bar"}); err != nil {
+		t.Error("Error while pushing to Redis queue", err)
+	}
+
+	values, err := q.PopBatch(10, 1)
+	if len(values) != 2 || values[0] != "foo" || values[1] != "bar" {
+		t.Error("Expected [foo bar] but got: ", values)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	values, err = q.PopBatch(10, 1)
+	if len(values) != 0 {
+		t.Error("Expected no values but got: ", values)
+	}
+	if err != ErrTimeout {
+		t.Error("Expected timeout error, got: ", err)
+	}
+}
+
+func TestMultiQueueContext(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+
+	var e error
+	if e = deleteKey(pool, "rq_test_multi_context"); e != nil {
+		t.Error("Unable to delete key in test setup")
+	}
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool}, "rq_test_multi_context")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := q.PopContext(ctx, 0); err != context.Canceled {
+		t.Error("Expected context canceled error, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected cancellation to interrupt the pop, took: ", elapsed)
+	}
+
+	if err := q.PushContext(ctx, "foo"); err != context.Canceled {
+		t.Error("Expected context canceled error, got: ", err)
+	}
+	if q.queues[0].ErrorRating() != 0 {
+		t.Error("Expected cancellation not to be recorded as a queue error")
+	}
+
+	if err := q.PushContext(context.Background(), "foo"); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	l, err := q.LengthContext(context.Background())
+	if l != 1 {
+		t.Error("Expect length to be 1, was: ", l)
+	}
+	if err != nil {
+		t.Error("Error while getting length of Redis queue", err)
+	}
+	q.Pop(1)
+}
+
+func TestMultiQueuePopIsFair(t *testing.T) {
+	pool1 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool2.Close()
+
+	QueueConnect(pool1, "rq_test_multi_fair").PushBatch([]string{"a1", "a2", "a3", "a4"})
+	QueueConnect(pool2, "rq_test_multi_fair").PushBatch([]string{"b1", "b2", "b3", "b4"})
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_fair")
+	counts := map[byte]int{}
+	for i := 0; i < 4; i++ {
+		value, err := q.Pop(1)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		counts[value[0]]++
+	}
+	if counts['a'] != 2 || counts['b'] != 2 {
+		t.Error("Expected pops to alternate between servers, got: ", counts)
+	}
+
+	values, err := q.PopBatch(10, 1)
+	if err != nil || len(values) != 2 {
+		t.Error("Expected the rest of one server's messages, got: ", values, err)
+	}
+	values, err = q.PopBatch(10, 1)
+	if err != nil || len(values) != 2 {
+		t.Error("Expected the rest of the other server's messages, got: ", values, err)
+	}
+}
+
+func TestMultiQueuePopFindsMessagesOnAnyServer(t *testing.T) {
+	pool1 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool2.Close()
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_any")
+	for _, pool := range []*redis.Pool{pool1, pool2, pool1, pool2} {
+		QueueConnect(pool, "rq_test_multi_any").Push("foo")
+		start := time.Now()
+		if value, err := q.Pop(1); value != "foo" || err != nil {
+			t.Error("Expected foo but got: ", value, err)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Error("Expected the message to be found without blocking, took: ", elapsed)
+		}
+	}
+
+	start := time.Now()
+	if value, err := q.Pop(1); value != "" || err != ErrTimeout {
+		t.Error("Expected timeout but got: ", value, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Error("Expected to wait for the timeout, took: ", elapsed)
+	}
+}
+
+func TestMultiQueuePopForeverWakesForAnyServer(t *testing.T) {
+	server2 := startServer(t)
+	pool1 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(server2.Addr())
+	defer pool2.Close()
+	pusher := createPoolWithConnectString(server2.Addr())
+	defer pusher.Close()
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_forever")
+	for i := 0; i < 2; i++ {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			QueueConnect(pusher, "rq_test_multi_forever").Push("foo")
+		}()
+
+		result := make(chan string, 1)
+		go func() {
+			value, _ := q.Pop(0)
+			result <- value
+		}()
+		select {
+		case value := <-result:
+			if value != "foo" {
+				t.Error("Expected foo but got: ", value)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected the pop to find the message on the second server")
+		}
+	}
+}
+
+func TestMultiQueueSurvivesServerFailure(t *testing.T) {
+	server1 := startServer(t)
+	pool1 := createPoolWithConnectString(server1.Addr())
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool2.Close()
+
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_failure", MultiQueueOptions{
+		PushRetries: 1,
+	})
+	if err := q.Push("before"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	server1.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := q.Push("after"); err != nil {
+			t.Error("Expected the push to fail over to the running server, got: ", err)
+		}
+	}
+	if l, _ := QueueConnect(pool2, "rq_test_multi_failure").Length(); l < 4 {
+		t.Error("Expected the pushes on the running server, length was: ", l)
+	}
+
+	q.CheckHealth()
+	healthy := q.HealthyQueues()
+	if len(healthy) != 1 || healthy[0].Server() != "foo2" {
+		t.Error("Expected only the running server to be healthy, got: ", healthy)
+	}
+	popped := map[string]int{}
+	for {
+		value, err := q.Pop(1)
+		if err != nil {
+			break
+		}
+		popped[value]++
+	}
+	if popped["after"] != 4 {
+		t.Error("Expected every later push to be popped, got: ", popped)
+	}
+}
+
+func TestMultiQueuePopWaitsForRecovery(t *testing.T) {
+	proxy := startProxy(t)
+	pool := createPoolWithConnectString(proxy.Addr())
+	defer pool.Close()
+	direct := createPool()
+	defer direct.Close()
+	deleteKey(direct, "rq_test_multi_recovery")
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"proxied": pool}, "rq_test_multi_recovery", MultiQueueOptions{
+		ErrorDecay: ErrorDecayOptions{HalfLife: 100 * time.Millisecond},
+	})
+
+	proxy.SetDown(true)
+	q.CheckHealth()
+	start := time.Now()
+	if _, err := q.Pop(1); err != ErrNoQueuesAvailable {
+		t.Error("Expected no queues to be available, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Error("Expected the pop to wait for its timeout, took: ", elapsed)
+	}
+
+	QueueConnect(direct, "rq_test_multi_recovery").Push("foo")
+	time.AfterFunc(200*time.Millisecond, func() { proxy.SetDown(false) })
+	if value, err := q.Pop(5); value != "foo" || err != nil {
+		t.Error("Expected the pop to wait for the server to recover, got: ", value, err)
+	}
+}
+
+func TestMultiQueueStatus(t *testing.T) {
+	pool1 := createPool()
+	defer pool1.Close()
+	pool2 := NewPool(":123", 1, 1, 240*time.Second)
+	defer pool2.Close()
+	q := NewMultiQueue(map[string]*redis.Pool{"up": pool1, "down": pool2}, "rq_test_queue")
+
+	q.CheckHealth()
+	status := q.Status()
+	if len(status) != 2 || status[0].Server != "down" || status[1].Server != "up" {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	if status[0].Healthy || status[0].LastProbeError == nil || status[0].ErrorRating == 0 {
+		t.Errorf("Expected down server to be unhealthy: %+v", status[0])
+	}
+	if !status[1].Healthy || status[1].LastProbeError != nil || status[1].LastProbe.IsZero() {
+		t.Errorf("Expected up server to be healthy: %+v", status[1])
+	}
+	if healthy := q.HealthyQueues(); len(healthy) != 1 || healthy[0].server != "up" {
+		t.Error("Expected only the up server to be healthy, got: ", healthy)
+	}
+}
+
+func TestMultiQueueBackgroundHealthCheck(t *testing.T) {
+	pool := NewPool(":123", 1, 1, 240*time.Second)
+	defer pool.Close()
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"down": pool}, "rq_test_queue", MultiQueueOptions{
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	defer q.Close()
+
+	if !waitFor(func() bool { return !q.Status()[0].Healthy }) {
+		t.Error("Expected the health checker to mark the server unhealthy")
+	}
+}
+
+func TestMultiQueueHealthCheckBlackhole(t *testing.T) {
+	proxy := startProxy(t)
+	pool1 := createPoolWithConnectString(startServer(t).Addr())
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(proxy.Addr())
+	defer pool2.Close()
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"up": pool1, "blackhole": pool2}, "rq_test_multi_blackhole", MultiQueueOptions{
+		ErrorDecay:          ErrorDecayOptions{ProbeTimeout: 100 * time.Millisecond},
+		HealthCheckInterval: 50 * time.Millisecond,
+	})
+
+	proxy.SetBlackhole(true)
+	if !waitFor(func() bool { return !q.Status()[0].Healthy }) {
+		t.Fatal("Expected the health checker to mark the black-holed server unhealthy")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			if err := q.Push("foo"); err != nil {
+				t.Error("Unexpected error: ", err)
+			}
+			if value, err := q.Pop(1); value != "foo" || err != nil {
+				t.Error("Expected foo but got: ", value, err)
+			}
+			if _, err := q.Length(); err != nil {
+				t.Error("Unexpected error: ", err)
+			}
+			q.Status()
+		}
+		q.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the healthy server to be used while the other is black-holed")
+	}
+}
+
+func TestMultiQueueHealthEvents(t *testing.T) {
+	pool1 := createPool()
+	defer pool1.Close()
+	pool2 := NewPool(":123", 1, 1, 240*time.Second)
+	defer pool2.Close()
+	q := NewMultiQueue(map[string]*redis.Pool{"up": pool1, "down": pool2}, "rq_test_queue")
+
+	var changes []string
+	q.OnHealthChange(func(server string, healthy bool, rating float64) {
+		changes = append(changes, fmt.Sprintf("%s:%t", server, healthy))
+	})
+	events := q.HealthEvents()
+
+	q.CheckHealth()
+	if len(changes) != 1 || changes[0] != "down:false" {
+		t.Error("Expected the down server to change to unhealthy, got: ", changes)
+	}
+	select {
+	case event := <-events:
+		if event.Server != "down" || event.Healthy || event.ErrorRating == 0 {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	default:
+		t.Error("Expected a health event")
+	}
+
+	q.CheckHealth()
+	if len(changes) != 1 {
+		t.Error("Expected no further changes, got: ", changes)
+	}
+
+	q.Close()
+	if _, ok := <-events; ok {
+		t.Error("Expected the events channel to be closed")
+	}
+}
+
 func BenchmarkMultiQueuePushPop(b *testing.B) {
 	pool1 := createPool()
 	defer pool1.Close()
@@ -160,6 +510,29 @@ func BenchmarkMultiQueuePushPop(b *testing.B) {
 	}
 }
 
+func BenchmarkMultiQueuePushPopBatch(b *testing.B) {
+	pool1 := createPool()
+	defer pool1.Close()
+	pool2 := createPool()
+	defer pool2.Close()
+
+	var e error
+	if e = deleteKey(pool1, "rq_test_multi_queue_pushpop_batch_bench"); e != nil {
+		b.Error("Unable to delete key in test setup")
+	}
+
+	q := NewMultiQueue(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_queue_pushpop_batch_bench")
+	values := []string{"foo", "foo", "foo", "foo", "foo", "foo", "foo", "foo", "foo", "foo"}
+	for i := 0; i < b.N; i++ {
+		q.PushBatch(values)
+		q.PopBatch(len(values), 1)
+	}
+
+	if e = deleteKey(pool1, "rq_test_multi_queue_pushpop_batch_bench"); e != nil {
+		b.Error("Unable to delete key in test cleanup")
+	}
+}
+
 func BenchmarkMultiQueueLength(b *testing.B) {
 	pool1 := createPool()
 	defer pool1.Close()
@@ -191,10 +564,41 @@ func deleteKey(pool *redis.Pool, key string) error {
 	return err
 }
 
+// testServer is the in-process Redis server the tests run against.
+var testServer *rqtest.Server
+
+func TestMain(m *testing.M) {
+	var err error
+	if testServer, err = rqtest.NewServer(); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to start test server: ", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// testConnectString returns the connect string for a database of the test
+// server.
+func testConnectString(db int) string {
+	return fmt.Sprintf("%s/%d", testServer.Addr(), db)
+}
+
+// startServer starts a separate server, closed when the test ends, for
+// tests that need backends which fail independently.
+func startServer(t *testing.T) *rqtest.Server {
+	s, err := rqtest.NewServer()
+	if err != nil {
+		t.Fatal("Unable to start server: ", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
 func createPoolWithConnectString(connectString string) *redis.Pool {
 	return NewPool(connectString, 1, 1, 240*time.Second)
 }
 
 func createPool() *redis.Pool {
-	return createPoolWithConnectString(":6379")
+	return createPoolWithConnectString(testServer.Addr())
 }
@@ -15,11 +15,33 @@
 // Package rq provides a simple queue abstraction that is backed by Redis.
 package rq
 
-import "github.com/garyburd/redigo/redis"
+import (
+	"context"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultVisibilityTimeout is the visibility timeout used by queues that do
+// not set one.
+const DefaultVisibilityTimeout = 30 * time.Second
 
 type Queue struct {
 	pooledConnection *redis.Pool
 	key              string
+
+	// VisibilityTimeout is how long a message popped with ReliablePop may go
+	// unacknowledged before it is returned to the queue by RequeueExpired.
+	// The DefaultVisibilityTimeout is used when zero.
+	VisibilityTimeout time.Duration
+
+	// MaxAttempts is the number of times a message may be delivered by
+	// ReliablePop before a failed delivery moves it to the dead-letter list
+	// instead of back onto the queue.  Messages are retried forever when zero.
+	// Attempts are counted per message ID for values pushed with
+	// PushMessage, but per value for bare values, so identical bare values
+	// share a count.
+	MaxAttempts int
 }
 
 // Connect to the Redis server at the specified address and create a queue
@@ -31,36 +53,121 @@ func QueueConnect(pooledConnection *redis.Pool, key string) *Queue {
 // Push will perform a left-push onto a Redis list/queue with the supplied
 // key and value.  An error will be returned if the operation failed.
 func (queue *Queue) Push(value string) error {
-	c := queue.pooledConnection.Get()
-	defer c.Close()
+	return queue.PushContext(context.Background(), value)
+}
 
-	_, err := c.Do("LPUSH", queue.key, value)
+// PushContext behaves like Push, returning the context's error if it is done
+// before the push completes.
+func (queue *Queue) PushContext(ctx context.Context, value string) error {
+	_, err := doContext(ctx, queue.pooledConnection, "LPUSH", queue.key, value)
 	return err
 }
 
 // Pop will perform a blocking right-pop from a Redis list/queue with the
-// supplied key.  An error will be returned if the operation failed.
+// supplied key.  ErrTimeout is returned if no message arrived before the
+// timeout, and an error will be returned if the operation failed.
 func (queue *Queue) Pop(timeout int) (string, error) {
-	c := queue.pooledConnection.Get()
-	defer c.Close()
+	return queue.PopContext(context.Background(), timeout)
+}
 
-	rep, err := redis.Strings(c.Do("BRPOP", queue.key, timeout))
+// PopContext behaves like Pop, giving up when the context is done.  The
+// timeout is shortened to the context's deadline, and a cancelled context
+// is noticed within a second, as the pop blocks for no more than a second
+// at a time.
+func (queue *Queue) PopContext(ctx context.Context, timeout int) (string, error) {
+	rep, err := redis.Strings(blockingDoContext(ctx, queue.pooledConnection, contextTimeout(ctx, timeout), "BRPOP", queue.key))
 	if err == nil {
 		return rep[1], nil
 	} else {
-		return "", err
+		return "", timeoutOrError(err)
 	}
 }
 
-// Length will return the number of items in the specified list/queue
-func (queue *Queue) Length() (int, error) {
+// PushBatch will perform a single variadic left-push of the values onto the
+// queue, so that they are popped in the order given.  An error will be
+// returned if the operation failed.
+func (queue *Queue) PushBatch(values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	_, err := c.Do("LPUSH", batchArgs(queue.key, values)...)
+	return err
+}
+
+// PopBatch will perform a blocking right-pop for the first message, then
+// pipeline non-blocking right-pops for up to max messages in total.
+// ErrTimeout is returned if no message arrived before the timeout, and an
+// error will be returned if the operation failed.
+func (queue *Queue) PopBatch(max int, timeout int) ([]string, error) {
 	c := queue.pooledConnection.Get()
 	defer c.Close()
 
-	rep, err := redis.Int(c.Do("LLEN", queue.key))
+	return popBatch(c, queue.key, max, timeout)
+}
+
+// Length will return the number of items in the specified list/queue
+func (queue *Queue) Length() (int, error) {
+	return queue.LengthContext(context.Background())
+}
+
+// LengthContext behaves like Length, returning the context's error if it is
+// done before the reply arrives.
+func (queue *Queue) LengthContext(ctx context.Context) (int, error) {
+	rep, err := redis.Int(doContext(ctx, queue.pooledConnection, "LLEN", queue.key))
 	if err == nil {
 		return rep, nil
 	} else {
 		return 0, err
 	}
 }
+
+func batchArgs(key string, values []string) []interface{} {
+	args := make([]interface{}, 0, len(values)+1)
+	args = append(args, key)
+	for _, value := range values {
+		args = append(args, value)
+	}
+	return args
+}
+
+// popBatch blocks for the first message on the list at key, then pipelines
+// RPOP commands to collect up to max messages without further blocking.
+func popBatch(c redis.Conn, key string, max int, timeout int) ([]string, error) {
+	rep, err := redis.Strings(c.Do("BRPOP", key, timeout))
+	if err != nil {
+		return nil, timeoutOrError(err)
+	}
+
+	return popMore([]string{rep[1]}, c, key, max)
+}
+
+// popMore pipelines RPOP commands to add to the messages already popped
+// from the list at key, until there are max messages or the list is empty.
+func popMore(messages []string, c redis.Conn, key string, max int) ([]string, error) {
+	if len(messages) >= max {
+		return messages, nil
+	}
+
+	for i := len(messages); i < max; i++ {
+		c.Send("RPOP", key)
+	}
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		return messages, err
+	}
+	for _, reply := range replies {
+		if reply == nil {
+			break
+		}
+		message, err := redis.String(reply, nil)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
@@ -16,8 +16,12 @@
 package rq
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestQueueConnectSuccessful(t *testing.T) {
@@ -80,6 +84,126 @@ func TestQueuePopSuccessful(t *testing.T) {
 	}
 }
 
+func TestQueuePushPopBatch(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_queue_batch")
+	deleteKey(pool, "rq_test_queue_batch")
+
+	err := q.PushBatch([]string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Error("Error while pushing to Redis queue", err)
+	}
+
+	values, err := q.PopBatch(2, 1)
+	if len(values) != 2 || values[0] != "foo" || values[1] != "bar" {
+		t.Error("Expected [foo bar] but got: ", values)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	values, err = q.PopBatch(5, 1)
+	if len(values) != 1 || values[0] != "baz" {
+		t.Error("Expected [baz] but got: ", values)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestQueuePopContextCancel(t *testing.T) {
+	server := startServer(t)
+	pool := createPoolWithConnectString(server.Addr())
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_queue_pop_cancel")
+	deleteKey(pool, "rq_test_queue_pop_cancel")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	value, err := q.PopContext(ctx, 0)
+	if err != context.Canceled {
+		t.Error("Expected context canceled error, got: ", err)
+	}
+	if value != "" {
+		t.Error("Expected no value but got: ", value)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected cancellation to interrupt the pop, took: ", elapsed)
+	}
+
+	// once the server has released the interrupted pop, it must not consume
+	// later messages
+	if !waitFor(func() bool { return server.Clients() == 0 }) {
+		t.Fatal("Expected the interrupted connection to be closed")
+	}
+	q.Push("foo")
+	if value, _ = q.Pop(1); value != "foo" {
+		t.Error("Expected foo but got: ", value)
+	}
+}
+
+func TestQueuePopContextDeadline(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_queue_pop_deadline")
+	deleteKey(pool, "rq_test_queue_pop_deadline")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := q.PopContext(ctx, 0); err != context.DeadlineExceeded {
+		t.Error("Expected deadline exceeded error, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected the deadline to interrupt the pop, took: ", elapsed)
+	}
+}
+
+func TestQueuePopContextReusesConnections(t *testing.T) {
+	var dials int32
+	pool := NewPoolWithOptions(&ConnectOptions{Network: "tcp", Address: testServer.Addr()}, 1, 1, 240*time.Second)
+	defer pool.Close()
+	dial := pool.Dial
+	pool.Dial = func() (redis.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dial()
+	}
+	q := QueueConnect(pool, "rq_test_queue_pop_reuse")
+	deleteKey(pool, "rq_test_queue_pop_reuse")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		q.Push("foo")
+		if value, err := q.PopContext(ctx, 1); value != "foo" || err != nil {
+			t.Error("Expected foo but got: ", value, err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Error("Expected the pops to reuse one pooled connection, dialed: ", n)
+	}
+}
+
+func TestQueueContextAlreadyDone(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_queue_context_done")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := q.PushContext(ctx, "foo"); err != context.Canceled {
+		t.Error("Expected context canceled error, got: ", err)
+	}
+	if _, err := q.LengthContext(ctx); err != context.Canceled {
+		t.Error("Expected context canceled error, got: ", err)
+	}
+}
+
 func BenchmarkQueuePushPop(b *testing.B) {
 	pool := createPool()
 	defer pool.Close()
@@ -100,3 +224,14 @@ func BenchmarkQueueLength(b *testing.B) {
 	}
 	q.Pop(1)
 }
+
+func BenchmarkQueuePushPopBatch(b *testing.B) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_queue_pushpop_batch_bench")
+	values := []string{"foo", "foo", "foo", "foo", "foo", "foo", "foo", "foo", "foo", "foo"}
+	for i := 0; i < b.N; i++ {
+		q.PushBatch(values)
+		q.PopBatch(len(values), 1)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Delivery is a message that was moved from a queue onto a consumer's
+// processing list by ReliablePop.  The message stays on the processing list
+// until it is acknowledged with Ack or returned with Nack, so it survives a
+// consumer crashing while handling it.
+type Delivery struct {
+	Value string
+
+	// Attempts is the number of times the message has been delivered,
+	// including this delivery.
+	Attempts int
+
+	queue         *Queue
+	processingKey string
+}
+
+// ReliablePop will perform a blocking right-pop from the queue and atomically
+// push the message onto the processing list for the named consumer.  The
+// returned Delivery must be acknowledged within the queue's visibility
+// timeout, otherwise it may be returned to the queue by RequeueExpired.
+// ErrTimeout is returned if no message arrived before the timeout.
+func (queue *Queue) ReliablePop(consumer string, timeout int) (*Delivery, error) {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	// The consumer is registered before popping so that the reaper finds
+	// the message even if the consumer fails before giving it a deadline.
+	if _, err := c.Do("SADD", queue.consumersKey(), consumer); err != nil {
+		return nil, err
+	}
+
+	processingKey := queue.processingKey(consumer)
+	rep, err := redis.String(c.Do("BRPOPLPUSH", queue.key, processingKey, timeout))
+	if err != nil {
+		return nil, timeoutOrError(err)
+	}
+
+	c.Send("MULTI")
+	c.Send("ZADD", deadlinesKey(processingKey), queue.deadline(), rep)
+	c.Send("HINCRBY", queue.attemptsKey(), historyField(rep), 1)
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := redis.Int(replies[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Delivery{Value: rep, Attempts: attempts, queue: queue, processingKey: processingKey}, nil
+}
+
+// Ack removes the delivery from the consumer's processing list, marking the
+// message as handled.  An error is returned if the delivery is no longer on
+// the processing list.
+func (d *Delivery) Ack() error {
+	return d.queue.settle(d, false, nil)
+}
+
+// Nack removes the delivery from the consumer's processing list.  When
+// requeue is true the message is returned to the queue so that it will be
+// the next message popped, unless it has reached the queue's MaxAttempts in
+// which case it is moved to the dead-letter list.  Otherwise it is discarded.
+func (d *Delivery) Nack(requeue bool) error {
+	return d.queue.settle(d, requeue, nil)
+}
+
+// NackWithError behaves like Nack, recording the cause of the failure so
+// that it is reported if the message is later moved to the dead-letter list.
+func (d *Delivery) NackWithError(requeue bool, cause error) error {
+	return d.queue.settle(d, requeue, cause)
+}
+
+func (queue *Queue) processingKey(consumer string) string {
+	return queue.key + ":processing:" + consumer
+}
+
+func (queue *Queue) consumersKey() string {
+	return queue.key + ":consumers"
+}
+
+// attemptsKey names the hash counting the deliveries of each message, keyed
+// by historyField.
+func (queue *Queue) attemptsKey() string {
+	return queue.key + ":attempts"
+}
+
+// errorsKey names the hash holding the last recorded failure of each message,
+// keyed by historyField.
+func (queue *Queue) errorsKey() string {
+	return queue.key + ":errors"
+}
+
+// historyField returns the field under which the delivery attempts and last
+// error of a value are recorded.  A value pushed with PushMessage is keyed
+// by its message ID, so identical payloads pushed as separate messages keep
+// separate histories.  A bare value is keyed by the value itself, so
+// identical bare values share one history: each delivery of any copy counts
+// as an attempt, and settling one copy with Ack or Nack(false) forgets the
+// history of the others.
+func historyField(value string) string {
+	if m, err := DecodeMessage(value); err == nil && m.ID != "" {
+		return envelopePrefix + m.ID
+	}
+	return value
+}
+
+// deadlinesKey names the sorted set holding the visibility deadline of each
+// message on a processing list.
+func deadlinesKey(processingKey string) string {
+	return processingKey + ":deadlines"
+}
+
+// deadline returns the visibility deadline, in milliseconds since the epoch,
+// for a message delivered now.
+func (queue *Queue) deadline() int64 {
+	timeout := queue.VisibilityTimeout
+	if timeout == 0 {
+		timeout = DefaultVisibilityTimeout
+	}
+	return unixMillis(time.Now().Add(timeout))
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// settle removes a delivery from its processing list as a single
+// transaction.  When requeue is true the message is returned to the right end
+// of the queue, or moved to the dead-letter list once it has used up its
+// delivery attempts.  The processing list is watched so a concurrent settle
+// of the same value cannot requeue it twice.
+func (queue *Queue) settle(d *Delivery, requeue bool, cause error) error {
+	c := queue.pooledConnection.Get()
+	defer c.Close()
+
+	for {
+		if _, err := c.Do("WATCH", d.processingKey); err != nil {
+			return err
+		}
+
+		values, err := redis.Strings(c.Do("LRANGE", d.processingKey, 0, -1))
+		if err != nil {
+			return err
+		}
+		copies := countString(values, d.Value)
+		if copies == 0 {
+			c.Do("UNWATCH")
+			return ErrDeliveryNotFound
+		}
+
+		lastError := errorString(cause)
+		if requeue && cause == nil && queue.exhausted(d.Attempts) {
+			if lastError, err = redis.String(c.Do("HGET", queue.errorsKey(), historyField(d.Value))); err != nil && err != redis.ErrNil {
+				return err
+			}
+		}
+
+		c.Send("MULTI")
+		c.Send("LREM", d.processingKey, 1, d.Value)
+		if copies == 1 {
+			c.Send("ZREM", deadlinesKey(d.processingKey), d.Value)
+		}
+		switch {
+		case !requeue:
+			c.Send("HDEL", queue.attemptsKey(), historyField(d.Value))
+			c.Send("HDEL", queue.errorsKey(), historyField(d.Value))
+		case queue.exhausted(d.Attempts):
+			queue.sendDeadLetter(c, d.Value, DeadReasonNacked, lastError, d.Attempts)
+		default:
+			if cause != nil {
+				c.Send("HSET", queue.errorsKey(), historyField(d.Value), cause.Error())
+			}
+			c.Send("RPUSH", queue.key, d.Value)
+		}
+		reply, err := c.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+		// the processing list changed while it was being watched, try again
+	}
+}
+
+func countString(values []string, value string) (n int) {
+	for _, v := range values {
+		if v == value {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestQueueReliablePopAck(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_reliable_ack")
+	processingKey := q.processingKey("worker1")
+	resetReliableQueue(pool, q, "worker1")
+
+	q.Push("foo")
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if d.Value != "foo" {
+		t.Error("Expected foo but got: ", d.Value)
+	}
+	if l := listLength(pool, processingKey); l != 1 {
+		t.Error("Expected 1 message on processing list, was: ", l)
+	}
+
+	if err = d.Ack(); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if l := listLength(pool, processingKey); l != 0 {
+		t.Error("Expected empty processing list, was: ", l)
+	}
+	if err = d.Ack(); err != ErrDeliveryNotFound {
+		t.Error("Expected delivery not found error, got: ", err)
+	}
+}
+
+func TestQueueReliablePopNackRequeue(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_reliable_nack")
+	resetReliableQueue(pool, q, "worker1")
+
+	q.Push("foo")
+	q.Push("bar")
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if err = d.Nack(true); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	value, err := q.Pop(1)
+	if value != "foo" {
+		t.Error("Expected requeued foo but got: ", value)
+	}
+	if err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	q.Pop(1)
+}
+
+func TestQueueReliablePopNackDiscard(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_reliable_discard")
+	processingKey := q.processingKey("worker1")
+	resetReliableQueue(pool, q, "worker1")
+
+	q.Push("foo")
+	d, err := q.ReliablePop("worker1", 1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if err = d.Nack(false); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	if l, _ := q.Length(); l != 0 {
+		t.Error("Expected empty queue, was: ", l)
+	}
+	if l := listLength(pool, processingKey); l != 0 {
+		t.Error("Expected empty processing list, was: ", l)
+	}
+}
+
+func TestQueueReliablePopTimeout(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_reliable_timeout")
+	resetReliableQueue(pool, q, "worker1")
+
+	d, err := q.ReliablePop("worker1", 1)
+	if d != nil {
+		t.Error("Expected no delivery but got: ", d.Value)
+	}
+	if err != ErrTimeout {
+		t.Error("Expected timeout error, got: ", err)
+	}
+	if !errors.Is(err, redis.ErrNil) {
+		t.Error("Expected timeout error to match redis.ErrNil")
+	}
+}
+
+func resetReliableQueue(pool *redis.Pool, q *Queue, consumers ...string) {
+	deleteKey(pool, q.key)
+	deleteKey(pool, q.consumersKey())
+	for _, consumer := range consumers {
+		deleteKey(pool, q.processingKey(consumer))
+		deleteKey(pool, deadlinesKey(q.processingKey(consumer)))
+	}
+}
+
+func listLength(pool *redis.Pool, key string) int {
+	conn := pool.Get()
+	defer conn.Close()
+
+	l, _ := redis.Int(conn.Do("LLEN", key))
+	return l
+}
@@ -0,0 +1,120 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replicasHeader is set on the envelope of a replicated message to the
+// number of servers it was written to.
+const replicasHeader = "rq-replicas"
+
+// DefaultClaimTTL is how long a replicated message is remembered as
+// delivered by MultiQueues that do not set a ClaimTTL.
+const DefaultClaimTTL = 24 * time.Hour
+
+// pushReplicated wraps the value in an envelope with a new message ID and
+// pushes it to the configured number of servers concurrently, succeeding
+// once the write quorum has acknowledged it.  Servers are taken in hash
+// ring order from the message ID, healthy servers first.  Copies written to
+// servers that did acknowledge are not removed when the quorum is missed.
+func (m *MultiQueue) pushReplicated(ctx context.Context, value string) error {
+	msg := NewMessage(value)
+	msg.Headers[replicasHeader] = strconv.Itoa(m.replicas)
+	encoded := msg.Encode()
+	targets := m.replicaQueues(msg.ID)
+
+	results := make(chan error, len(targets))
+	for _, q := range targets {
+		go func(q *ErrorDecayQueue) {
+			_, err := doContext(ctx, q.pooledConnection, "LPUSH", m.queueName, encoded)
+			if err != nil && err != ctx.Err() {
+				err = recordError(q, err)
+			}
+			results <- err
+		}(q)
+	}
+
+	acks := 0
+	var lastErr error
+	for range targets {
+		if err := <-results; err == nil {
+			acks++
+		} else {
+			lastErr = err
+		}
+	}
+	if acks >= m.writeQuorum {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Replicated push acknowledged by %d of %d servers, quorum is %d: %w", acks, len(targets), m.writeQuorum, lastErr)
+}
+
+// replicaQueues returns the queues a replicated message with the given ID
+// is written to.
+func (m *MultiQueue) replicaQueues(id string) []*ErrorDecayQueue {
+	healthy, unhealthy := []*ErrorDecayQueue{}, []*ErrorDecayQueue{}
+	for _, q := range m.ring.queues(id) {
+		if q.IsHealthy() {
+			healthy = append(healthy, q)
+		} else {
+			unhealthy = append(unhealthy, q)
+		}
+	}
+	return append(healthy, unhealthy...)[:m.replicas]
+}
+
+// claim unwraps a popped value, returning false if it is a copy of a
+// replicated message that has already been delivered.  Deliveries are
+// recorded with a SET NX on the first healthy server on the hash ring from
+// the message ID.  The message is delivered if the claim cannot be
+// recorded, so a copy may be delivered more than once while servers fail.
+func (m *MultiQueue) claim(value string) (string, bool) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return value, true
+	}
+	msg, err := DecodeMessage(value)
+	if err != nil || msg.Headers[replicasHeader] == "" {
+		return value, true
+	}
+
+	q, err := m.SelectQueueForKey(msg.ID)
+	if err != nil {
+		return msg.Payload, true
+	}
+
+	conn := q.pooledConnection.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", m.claimKey(msg.ID), 1, "NX", "PX", int64(m.claimTTL/time.Millisecond))
+	if err != nil {
+		recordError(q, err)
+		return msg.Payload, true
+	}
+	return msg.Payload, reply != nil
+}
+
+func (m *MultiQueue) claimKey(id string) string {
+	return m.queueName + ":claimed:" + id
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// createReplicaPools starts the given number of separate servers and
+// creates a pool for each.
+func createReplicaPools(t *testing.T, servers int) map[string]*redis.Pool {
+	pools := map[string]*redis.Pool{}
+	for i := 0; i < servers; i++ {
+		s := startServer(t)
+		pools[s.Addr()] = createPoolWithConnectString(s.Addr())
+	}
+	return pools
+}
+
+func closePools(pools map[string]*redis.Pool) {
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
+
+func totalLength(pools map[string]*redis.Pool, key string) (total int) {
+	for _, pool := range pools {
+		l, _ := QueueConnect(pool, key).Length()
+		total = total + l
+	}
+	return
+}
+
+func TestMultiQueueReplicatedPush(t *testing.T) {
+	pools := createReplicaPools(t, 3)
+	defer closePools(pools)
+	q := NewMultiQueueWithOptions(pools, "rq_test_replicated", MultiQueueOptions{Replicas: 2})
+
+	if err := q.Push("foo"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if l := totalLength(pools, "rq_test_replicated"); l != 2 {
+		t.Error("Expected the value on 2 servers, found: ", l)
+	}
+
+	if value, err := q.Pop(1); value != "foo" || err != nil {
+		t.Error("Expected foo but got: ", value, err)
+	}
+	if value, err := q.Pop(1); value != "" || err != ErrTimeout {
+		t.Error("Expected the second copy to be dropped, got: ", value, err)
+	}
+	if l := totalLength(pools, "rq_test_replicated"); l != 0 {
+		t.Error("Expected both copies to be popped, found: ", l)
+	}
+}
+
+func TestMultiQueueReplicatedBatch(t *testing.T) {
+	pools := createReplicaPools(t, 2)
+	defer closePools(pools)
+	q := NewMultiQueueWithOptions(pools, "rq_test_replicated_batch", MultiQueueOptions{Replicas: 2})
+
+	if err := q.PushBatch([]string{"a", "b", "c"}); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	values := []string{}
+	for {
+		batch, err := q.PopBatch(10, 1)
+		if err == ErrTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		values = append(values, batch...)
+	}
+	sort.Strings(values)
+	if len(values) != 3 || values[0] != "a" || values[1] != "b" || values[2] != "c" {
+		t.Error("Expected each value once, got: ", values)
+	}
+}
+
+func TestMultiQueueReplicatedQuorum(t *testing.T) {
+	pools := createReplicaPools(t, 2)
+	pools["down"] = NewPool(":123", 1, 1, 240*time.Second)
+	defer closePools(pools)
+
+	q := NewMultiQueueWithOptions(pools, "rq_test_replicated_quorum", MultiQueueOptions{Replicas: 3, WriteQuorum: 3})
+	if err := q.Push("foo"); err == nil {
+		t.Error("Expected the push to miss its quorum")
+	}
+
+	q = NewMultiQueueWithOptions(pools, "rq_test_replicated_quorum", MultiQueueOptions{Replicas: 3})
+	if err := q.Push("bar"); err != nil {
+		t.Error("Expected a majority quorum to succeed, got: ", err)
+	}
+
+	delivered := map[string]int{}
+	for {
+		value, err := q.Pop(1)
+		if err == ErrTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		delivered[value]++
+	}
+	if delivered["foo"] != 1 || delivered["bar"] != 1 {
+		t.Error("Expected each value to be delivered once, got: ", delivered)
+	}
+}
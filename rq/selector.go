@@ -0,0 +1,162 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Selector chooses the queue a MultiQueue pushes to.  Select is given the
+// healthy queues, or every queue when none are healthy, and is never given
+// an empty slice.  It must be safe for concurrent use.
+type Selector interface {
+	Select(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error)
+}
+
+// SelectorFunc adapts an ordinary function to the Selector interface.
+type SelectorFunc func(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error)
+
+func (f SelectorFunc) Select(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	return f(queues)
+}
+
+// RandomSelector chooses a queue uniformly at random.  It is used by
+// MultiQueues that are not given a Selector.
+var RandomSelector Selector = SelectorFunc(func(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	return queues[rand.Intn(len(queues))], nil
+})
+
+type roundRobinSelector struct {
+	next uint32
+}
+
+// NewRoundRobinSelector creates a Selector that chooses each queue in turn.
+func NewRoundRobinSelector() Selector {
+	return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Select(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	n := atomic.AddUint32(&s.next, 1) - 1
+	return queues[n%uint32(len(queues))], nil
+}
+
+type weightedSelector struct {
+	weights map[string]int
+}
+
+// NewWeightedSelector creates a Selector that chooses queues at random in
+// proportion to the weight given for their server.  Servers without a
+// weight have a weight of 1, and servers with a weight of zero or less are
+// never chosen.
+func NewWeightedSelector(weights map[string]int) Selector {
+	copied := make(map[string]int, len(weights))
+	for server, weight := range weights {
+		copied[server] = weight
+	}
+	return &weightedSelector{weights: copied}
+}
+
+func (s *weightedSelector) weight(q *ErrorDecayQueue) int {
+	weight, ok := s.weights[q.Server()]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+func (s *weightedSelector) Select(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	total := 0
+	for _, q := range queues {
+		total = total + s.weight(q)
+	}
+	if total == 0 {
+		return nil, ErrNoQueuesAvailable
+	}
+
+	n := rand.Intn(total)
+	for _, q := range queues {
+		if n = n - s.weight(q); n < 0 {
+			return q, nil
+		}
+	}
+	return queues[len(queues)-1], nil
+}
+
+type leastLoadedSelector struct{}
+
+// NewLeastLoadedSelector creates a Selector that chooses the queue with the
+// fewest messages, issuing an LLEN to every queue on each selection.  Queues
+// whose length cannot be read are passed over, unless none can be read.
+func NewLeastLoadedSelector() Selector {
+	return leastLoadedSelector{}
+}
+
+func (leastLoadedSelector) Select(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	var selected *ErrorDecayQueue
+	least := 0
+	for _, q := range queues {
+		length, err := q.length()
+		if err != nil {
+			continue
+		}
+		if selected == nil || length < least {
+			selected, least = q, length
+		}
+	}
+	if selected == nil {
+		return RandomSelector.Select(queues)
+	}
+	return selected, nil
+}
+
+type latencySelector struct{}
+
+// NewLatencySelector creates a Selector that chooses the queue whose server
+// answered its last probe fastest, breaking ties at random.  Queues that
+// have not been probed are preferred, so that every server is measured;
+// latencies are only kept up to date when the MultiQueue has a
+// HealthCheckInterval.
+func NewLatencySelector() Selector {
+	return latencySelector{}
+}
+
+func (latencySelector) Select(queues []*ErrorDecayQueue) (*ErrorDecayQueue, error) {
+	var fastest []*ErrorDecayQueue
+	var least BackendStatus
+	for _, q := range queues {
+		status := q.Status()
+		if len(fastest) == 0 || status.LastProbeLatency < least.LastProbeLatency {
+			fastest, least = []*ErrorDecayQueue{q}, status
+		} else if status.LastProbeLatency == least.LastProbeLatency {
+			fastest = append(fastest, q)
+		}
+	}
+	return RandomSelector.Select(fastest)
+}
+
+// length returns the number of messages on the queue's list.
+func (e *ErrorDecayQueue) length() (int, error) {
+	conn := e.pooledConnection.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("LLEN", e.queueName))
+}
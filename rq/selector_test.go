@@ -0,0 +1,118 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func selectorTestQueues(pool *redis.Pool, servers ...string) []*ErrorDecayQueue {
+	queues := []*ErrorDecayQueue{}
+	for _, server := range servers {
+		queues = append(queues, NewErrorDecayQueue(server, "rq_test_selector", pool))
+	}
+	return queues
+}
+
+func countSelections(t *testing.T, s Selector, queues []*ErrorDecayQueue, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		q, err := s.Select(queues)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		counts[q.Server()]++
+	}
+	return counts
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	queues := selectorTestQueues(nil, "foo1", "foo2", "foo3")
+	counts := countSelections(t, NewRoundRobinSelector(), queues, 9)
+	if counts["foo1"] != 3 || counts["foo2"] != 3 || counts["foo3"] != 3 {
+		t.Error("Expected each queue to be selected 3 times, got: ", counts)
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	queues := selectorTestQueues(nil, "big", "small", "default", "off")
+	s := NewWeightedSelector(map[string]int{"big": 8, "small": 1, "off": 0})
+	counts := countSelections(t, s, queues, 10000)
+	if counts["off"] != 0 {
+		t.Error("Expected a zero weight queue never to be selected, got: ", counts)
+	}
+	if counts["big"] < 7000 || counts["small"] > 1500 || counts["default"] > 1500 {
+		t.Error("Expected selections in proportion to weight, got: ", counts)
+	}
+
+	if _, err := s.Select(queues[3:]); err != ErrNoQueuesAvailable {
+		t.Error("Expected no queues available error, got: ", err)
+	}
+}
+
+func TestLeastLoadedSelector(t *testing.T) {
+	pool1 := createPoolWithConnectString(testConnectString(1))
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(testConnectString(2))
+	defer pool2.Close()
+	deleteKey(pool1, "rq_test_selector")
+	deleteKey(pool2, "rq_test_selector")
+	QueueConnect(pool1, "rq_test_selector").PushBatch([]string{"foo", "bar"})
+	QueueConnect(pool2, "rq_test_selector").Push("foo")
+
+	queues := append(selectorTestQueues(pool1, "foo1"), selectorTestQueues(pool2, "foo2")...)
+	counts := countSelections(t, NewLeastLoadedSelector(), queues, 5)
+	if counts["foo2"] != 5 {
+		t.Error("Expected the shorter queue to be selected, got: ", counts)
+	}
+
+	deleteKey(pool1, "rq_test_selector")
+	deleteKey(pool2, "rq_test_selector")
+}
+
+func TestLatencySelector(t *testing.T) {
+	queues := selectorTestQueues(nil, "fast", "slow")
+	queues[0].lastProbeLatency = time.Millisecond
+	queues[1].lastProbeLatency = 10 * time.Millisecond
+	counts := countSelections(t, NewLatencySelector(), queues, 5)
+	if counts["fast"] != 5 {
+		t.Error("Expected the fastest queue to be selected, got: ", counts)
+	}
+}
+
+func TestMultiQueueSelector(t *testing.T) {
+	pool1 := createPoolWithConnectString(testConnectString(1))
+	defer pool1.Close()
+	pool2 := createPoolWithConnectString(testConnectString(2))
+	defer pool2.Close()
+	deleteKey(pool1, "rq_test_multi_selector")
+	deleteKey(pool2, "rq_test_multi_selector")
+
+	q := NewMultiQueueWithOptions(map[string]*redis.Pool{"foo1": pool1, "foo2": pool2}, "rq_test_multi_selector", MultiQueueOptions{
+		Selector: NewWeightedSelector(map[string]int{"foo1": 0}),
+	})
+	for i := 0; i < 5; i++ {
+		q.Push("foo")
+	}
+	if l, _ := QueueConnect(pool2, "rq_test_multi_selector").Length(); l != 5 {
+		t.Error("Expected every push to go to foo2, length was: ", l)
+	}
+
+	deleteKey(pool2, "rq_test_multi_selector")
+}
@@ -0,0 +1,307 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// switchMasterChannel is the Sentinel channel announcing failovers.
+const switchMasterChannel = "+switch-master"
+
+var masterChangedError = errors.New("Master has changed")
+
+// Sentinel tracks the master of a Redis deployment monitored by Redis
+// Sentinel.  Its fields must be set before it is used.
+type Sentinel struct {
+	// Addrs are the addresses of the sentinels, which are asked in order.
+	Addrs []string
+
+	// MasterName is the name the sentinels monitor the master under.
+	MasterName string
+
+	// Options are used to connect to the sentinels.  The Network and
+	// Address are ignored.
+	Options ConnectOptions
+
+	// RetryInterval is how long to wait before resubscribing to failover
+	// announcements after losing a sentinel.  One second is used when zero.
+	RetryInterval time.Duration
+
+	mu           sync.Mutex
+	master       string
+	stale        bool
+	generation   uint64
+	quit         chan struct{}
+	done         chan struct{}
+	subscription redis.Conn
+}
+
+// NewSentinel creates a Sentinel that asks the sentinels at the given
+// addresses for the master with the given name.
+func NewSentinel(addrs []string, masterName string) *Sentinel {
+	return &Sentinel{Addrs: addrs, MasterName: masterName}
+}
+
+// MasterAddr returns the address of the current master, asking the
+// sentinels if it is not known.
+func (s *Sentinel) MasterAddr() (string, error) {
+	addr, _, err := s.currentMaster()
+	return addr, err
+}
+
+// currentMaster returns the master's address along with the generation,
+// which changes whenever the master does.
+func (s *Sentinel) currentMaster() (string, uint64, error) {
+	s.mu.Lock()
+	if s.master != "" && !s.stale {
+		defer s.mu.Unlock()
+		return s.master, s.generation, nil
+	}
+	s.mu.Unlock()
+
+	addr, err := s.discover()
+	if err != nil {
+		return "", 0, err
+	}
+	return addr, s.setMaster(addr), nil
+}
+
+// discover asks each sentinel in turn for the master's address.
+func (s *Sentinel) discover() (string, error) {
+	err := fmt.Errorf("No sentinels configured for master: %s", s.MasterName)
+	for _, sentinelAddr := range s.Addrs {
+		var c redis.Conn
+		if c, err = s.dial(sentinelAddr, s.Options.ReadTimeout); err != nil {
+			continue
+		}
+
+		var reply []string
+		reply, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.MasterName))
+		c.Close()
+		if err == redis.ErrNil {
+			err = fmt.Errorf("Sentinel %s does not know master: %s", sentinelAddr, s.MasterName)
+		} else if err == nil && len(reply) == 2 {
+			return net.JoinHostPort(reply[0], reply[1]), nil
+		}
+	}
+	return "", err
+}
+
+func (s *Sentinel) dial(addr string, readTimeout time.Duration) (redis.Conn, error) {
+	options := s.Options
+	options.Network, options.Address, options.Database = "tcp", addr, 0
+	options.ReadTimeout = readTimeout
+	return options.Dial()
+}
+
+// setMaster records the master's address, starting a new generation if it
+// has changed, and returns the current generation.
+func (s *Sentinel) setMaster(addr string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if addr != s.master {
+		s.master = addr
+		s.generation++
+	}
+	s.stale = false
+	return s.generation
+}
+
+// invalidate marks the master as needing to be rediscovered, if it has not
+// changed since the given generation.
+func (s *Sentinel) invalidate(generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation == s.generation {
+		s.stale = true
+	}
+}
+
+// Watch subscribes to the sentinels' failover announcements in the
+// background, so that a new master is used as soon as it is promoted.
+// Calling Watch on a watching Sentinel has no effect.
+func (s *Sentinel) Watch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quit != nil {
+		return
+	}
+	s.quit, s.done = make(chan struct{}), make(chan struct{})
+	go s.watch(s.quit, s.done)
+}
+
+// Close stops watching for failovers.
+func (s *Sentinel) Close() error {
+	s.mu.Lock()
+	quit, done := s.quit, s.done
+	if quit == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	close(quit)
+	s.quit, s.done = nil, nil
+	if s.subscription != nil {
+		s.subscription.Close()
+	}
+	s.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+func (s *Sentinel) watch(quit chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	retryInterval := s.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = time.Second
+	}
+
+	for {
+		for _, sentinelAddr := range s.Addrs {
+			if c, err := s.dial(sentinelAddr, 0); err == nil {
+				s.subscribe(c, quit)
+				break
+			}
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// subscribe follows failover announcements on the connection until it
+// fails or the Sentinel is closed.
+func (s *Sentinel) subscribe(c redis.Conn, quit chan struct{}) {
+	defer c.Close()
+
+	s.mu.Lock()
+	select {
+	case <-quit:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.subscription = c
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.subscription = nil
+		s.mu.Unlock()
+	}()
+
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(switchMasterChannel); err != nil {
+		return
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			// catch up on any failover missed while unsubscribed
+			if addr, err := s.discover(); err == nil {
+				s.setMaster(addr)
+			}
+		case redis.Message:
+			// <master name> <old ip> <old port> <new ip> <new port>
+			fields := strings.Fields(string(v.Data))
+			if len(fields) == 5 && fields[0] == s.MasterName {
+				s.setMaster(net.JoinHostPort(fields[3], fields[4]))
+			}
+		case error:
+			return
+		}
+	}
+}
+
+// sentinelConn is a connection to the master as of a generation.
+type sentinelConn struct {
+	redis.Conn
+	generation uint64
+}
+
+// checkRole returns an error unless the server is a master.
+func checkRole(c redis.Conn) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	var role string
+	if _, err = redis.Scan(reply, &role); err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("Server is not a master: role=%s", role)
+	}
+	return nil
+}
+
+// NewSentinelPool creates a pool of connections to the master tracked by
+// the sentinel, using the options for everything but the address, and
+// starts watching for failovers.  Connections are checked to still be to
+// the current master, and that it has the master role, before each use.
+// The Sentinel should be closed once the pool is no longer used.
+func NewSentinelPool(sentinel *Sentinel, options *ConnectOptions, maxIdle int, maxActive int, idleTime time.Duration) *redis.Pool {
+	sentinel.Watch()
+
+	pool := NewPoolWithOptions(options, maxIdle, maxActive, idleTime)
+	pool.Dial = func() (redis.Conn, error) {
+		addr, generation, err := sentinel.currentMaster()
+		if err != nil {
+			return nil, err
+		}
+
+		masterOptions := *options
+		masterOptions.Network, masterOptions.Address = "tcp", addr
+		c, err := masterOptions.Dial()
+		if err != nil {
+			sentinel.invalidate(generation)
+			return nil, err
+		}
+		if err = checkRole(c); err != nil {
+			c.Close()
+			sentinel.invalidate(generation)
+			return nil, err
+		}
+		return &sentinelConn{Conn: c, generation: generation}, nil
+	}
+	pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		if sc, ok := c.(*sentinelConn); ok {
+			sentinel.mu.Lock()
+			changed := sc.generation != sentinel.generation
+			sentinel.mu.Unlock()
+			if changed {
+				return masterChangedError
+			}
+		}
+		return checkRole(c)
+	}
+	return pool
+}
@@ -0,0 +1,255 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubServer is a minimal RESP server that answers each command with the
+// reply returned by a handler, and supports SUBSCRIBE for publishing
+// messages to clients.
+type stubServer struct {
+	listener   net.Listener
+	newHandler func() func(args []string) interface{}
+
+	mu          sync.Mutex
+	subscribers []net.Conn
+}
+
+func newStubServer(t *testing.T, handler func(args []string) interface{}) *stubServer {
+	return newSessionStubServer(t, func() func(args []string) interface{} { return handler })
+}
+
+// newSessionStubServer creates a stubServer calling newHandler for the
+// handler of each connection, so that it may keep per-connection state.
+func newSessionStubServer(t *testing.T, newHandler func() func(args []string) interface{}) *stubServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubServer{listener: listener, newHandler: newHandler}
+	t.Cleanup(s.close)
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *stubServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *stubServer) close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.subscribers {
+		c.Close()
+	}
+}
+
+func (s *stubServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	handler := s.newHandler()
+	for {
+		args, err := readStubCommand(r)
+		if err != nil {
+			c.Close()
+			return
+		}
+
+		if strings.ToUpper(args[0]) == "SUBSCRIBE" {
+			s.mu.Lock()
+			s.subscribers = append(s.subscribers, c)
+			writeStubReply(c, []interface{}{"subscribe", args[1], int64(1)})
+			s.mu.Unlock()
+			continue
+		}
+		writeStubReply(c, handler(args))
+	}
+}
+
+// publish sends a message on the channel to every subscribed client.
+func (s *stubServer) publish(channel string, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.subscribers {
+		writeStubReply(c, []interface{}{"message", channel, message})
+	}
+}
+
+func readStubCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func writeStubReply(w io.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v.Error())
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, element := range v {
+			writeStubReply(w, element)
+		}
+	}
+}
+
+// stubSentinel creates a sentinel reporting the master address returned by
+// the function.
+func stubSentinel(t *testing.T, master func() string) *stubServer {
+	return newStubServer(t, func(args []string) interface{} {
+		if strings.ToUpper(args[0]) == "SENTINEL" && len(args) == 3 && args[2] == "mymaster" {
+			host, port, _ := net.SplitHostPort(master())
+			return []interface{}{host, port}
+		}
+		return fmt.Errorf("ERR unknown command '%s'", args[0])
+	})
+}
+
+func TestSentinelPoolDiscoversMaster(t *testing.T) {
+	sentinel := NewSentinel([]string{"127.0.0.1:1", stubSentinel(t, testServer.Addr).addr()}, "mymaster")
+	defer sentinel.Close()
+	pool := NewSentinelPool(sentinel, &ConnectOptions{Database: 8}, 1, 1, 240*time.Second)
+	defer pool.Close()
+
+	if addr, err := sentinel.MasterAddr(); addr != testServer.Addr() || err != nil {
+		t.Error("Expected the master address but got: ", addr, err)
+	}
+
+	deleteKey(pool, "rq_test_sentinel")
+	q := QueueConnect(pool, "rq_test_sentinel")
+	if err := q.Push("foo"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if value, err := q.Pop(1); value != "foo" || err != nil {
+		t.Error("Expected foo but got: ", value, err)
+	}
+}
+
+func TestSentinelPoolRejectsReplica(t *testing.T) {
+	replica := newStubServer(t, func(args []string) interface{} {
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return []interface{}{"slave", "127.0.0.1", int64(6379), "connected", int64(0)}
+		case "PING":
+			return "PONG"
+		}
+		return fmt.Errorf("READONLY You can't write against a read only replica.")
+	})
+	sentinel := NewSentinel([]string{stubSentinel(t, replica.addr).addr()}, "mymaster")
+	defer sentinel.Close()
+	pool := NewSentinelPool(sentinel, &ConnectOptions{}, 1, 1, 240*time.Second)
+	defer pool.Close()
+
+	err := QueueConnect(pool, "rq_test_sentinel").Push("foo")
+	if err == nil || !strings.Contains(err.Error(), "not a master") {
+		t.Error("Expected a role error, got: ", err)
+	}
+}
+
+func TestSentinelPoolFollowsSwitchMaster(t *testing.T) {
+	listener1, _ := net.Listen("tcp", "127.0.0.1:0")
+	accepted1 := forward(t, listener1)
+	listener2, _ := net.Listen("tcp", "127.0.0.1:0")
+	accepted2 := forward(t, listener2)
+
+	var mu sync.Mutex
+	master := listener1.Addr().String()
+	stub := stubSentinel(t, func() string { mu.Lock(); defer mu.Unlock(); return master })
+
+	sentinel := NewSentinel([]string{stub.addr()}, "mymaster")
+	defer sentinel.Close()
+	pool := NewSentinelPool(sentinel, &ConnectOptions{Database: 8}, 1, 1, 240*time.Second)
+	defer pool.Close()
+	deleteKey(pool, "rq_test_sentinel_switch")
+	q := QueueConnect(pool, "rq_test_sentinel_switch")
+
+	q.Push("foo")
+	if n := atomic.LoadInt32(accepted1); n != 1 {
+		t.Error("Expected one connection to the first master, got: ", n)
+	}
+
+	mu.Lock()
+	master = listener2.Addr().String()
+	mu.Unlock()
+	_, oldPort, _ := net.SplitHostPort(listener1.Addr().String())
+	_, newPort, _ := net.SplitHostPort(listener2.Addr().String())
+	if !waitFor(func() bool {
+		stub.publish(switchMasterChannel, "mymaster 127.0.0.1 "+oldPort+" 127.0.0.1 "+newPort)
+		addr, _ := sentinel.MasterAddr()
+		return addr == listener2.Addr().String()
+	}) {
+		t.Fatal("Expected the sentinel to follow the switch")
+	}
+
+	if value, err := q.Pop(1); value != "foo" || err != nil {
+		t.Error("Expected foo but got: ", value, err)
+	}
+	if n := atomic.LoadInt32(accepted2); n != 1 {
+		t.Error("Expected a connection to the new master, got: ", n)
+	}
+}
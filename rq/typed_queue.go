@@ -0,0 +1,66 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+// stringQueue is the set of operations that TypedQueue and Worker need, which
+// is implemented by every Q and by PriorityQueue.
+type stringQueue interface {
+	Push(value string) error
+	Pop(timeout int) (string, error)
+	Length() (int, error)
+}
+
+// TypedQueue wraps a Q or PriorityQueue, encoding values of type T with a
+// Codec when they are pushed and decoding them when they are popped.
+type TypedQueue[T any] struct {
+	queue stringQueue
+	codec Codec
+}
+
+// NewTypedQueue creates a TypedQueue over the given queue.
+func NewTypedQueue[T any](queue stringQueue, codec Codec) *TypedQueue[T] {
+	return &TypedQueue[T]{queue: queue, codec: codec}
+}
+
+// Push will encode the value and push it onto the underlying queue.  An
+// error will be returned if encoding or the push failed.
+func (tq *TypedQueue[T]) Push(value T) error {
+	data, err := tq.codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tq.queue.Push(string(data))
+}
+
+// Pop will perform a blocking pop from the underlying queue and decode the
+// message.  A *DecodeError is returned if the message could not be decoded,
+// and ErrTimeout if no message arrived before the timeout.
+func (tq *TypedQueue[T]) Pop(timeout int) (value T, err error) {
+	var message string
+	if message, err = tq.queue.Pop(timeout); err != nil {
+		return
+	}
+
+	if e := tq.codec.Unmarshal([]byte(message), &value); e != nil {
+		err = &DecodeError{Message: message, Err: e}
+	}
+	return
+}
+
+// Length will return the number of items on the underlying queue.
+func (tq *TypedQueue[T]) Length() (int, error) {
+	return tq.queue.Length()
+}
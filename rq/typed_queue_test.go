@@ -0,0 +1,119 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type testJob struct {
+	ID     int
+	Name   string
+	Inputs []string
+}
+
+func TestTypedQueueCodecs(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+
+	for name, codec := range map[string]Codec{"json": JSONCodec{}, "gob": GobCodec{}} {
+		deleteKey(pool, "rq_test_typed_"+name)
+		q := NewTypedQueue[testJob](QueueConnect(pool, "rq_test_typed_"+name), codec)
+
+		job := testJob{ID: 7, Name: "encode", Inputs: []string{"a.mp4", "b.mp4"}}
+		if err := q.Push(job); err != nil {
+			t.Errorf("%s: error while pushing to Redis queue: %v", name, err)
+		}
+
+		value, err := q.Pop(1)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if value.ID != job.ID || value.Name != job.Name || len(value.Inputs) != 2 || value.Inputs[1] != "b.mp4" {
+			t.Errorf("%s: expected %+v but got: %+v", name, job, value)
+		}
+	}
+}
+
+// testMessage marshals itself in the style of a generated protocol buffer.
+type testMessage struct {
+	Body string
+}
+
+func (m *testMessage) Marshal() ([]byte, error) {
+	return []byte("msg:" + m.Body), nil
+}
+
+func (m *testMessage) Unmarshal(data []byte) error {
+	if len(data) < 4 || string(data[:4]) != "msg:" {
+		return errors.New("invalid message")
+	}
+	m.Body = string(data[4:])
+	return nil
+}
+
+func TestTypedQueueMarshalerCodec(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_typed_marshaler")
+
+	q := NewTypedQueue[*testMessage](QueueConnect(pool, "rq_test_typed_marshaler"), MarshalerCodec{})
+	if err := q.Push(&testMessage{Body: "hello"}); err != nil {
+		t.Error("Error while pushing to Redis queue", err)
+	}
+
+	value, err := q.Pop(1)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if value == nil || value.Body != "hello" {
+		t.Error("Expected hello but got: ", value)
+	}
+}
+
+func TestTypedQueueDecodeError(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_typed_decode")
+
+	raw := QueueConnect(pool, "rq_test_typed_decode")
+	raw.Push("not json")
+
+	q := NewTypedQueue[testJob](raw, JSONCodec{})
+	_, err := q.Pop(1)
+
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatal("Expected decode error, got: ", err)
+	}
+	if decodeErr.Message != "not json" {
+		t.Error("Expected undecodable message to be reported, got: ", decodeErr.Message)
+	}
+}
+
+func TestTypedQueueMultiQueueTimeout(t *testing.T) {
+	pool := createPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_typed_multi")
+
+	q := NewTypedQueue[testJob](NewMultiQueue(map[string]*redis.Pool{"foo1": pool}, "rq_test_typed_multi"), JSONCodec{})
+	if _, err := q.Pop(1); err != ErrTimeout {
+		t.Error("Expected timeout error, got: ", err)
+	}
+}
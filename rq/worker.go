@@ -0,0 +1,209 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Handler processes a single message popped by a Worker.  Returning an error
+// marks the message as failed.
+type Handler func(ctx context.Context, message string) error
+
+// reliableQueue is implemented by queues that support acknowledged delivery.
+type reliableQueue interface {
+	ReliablePop(consumer string, timeout int) (*Delivery, error)
+}
+
+// workerErrorBackoff is how long a fetch loop waits after a queue error.
+const workerErrorBackoff = time.Second
+
+// Worker pops messages from a Q or PriorityQueue and runs a Handler for each
+// of them on a fixed number of goroutines.
+type Worker struct {
+	queue       stringQueue
+	handler     Handler
+	concurrency int
+
+	// Consumer, if set and the queue is a *Queue, names the processing list
+	// used to pop messages with ReliablePop.  Messages are then acknowledged
+	// when the handler succeeds and nacked for retry when it fails.  Plain
+	// pops are used otherwise.
+	Consumer string
+
+	// JobTimeout, if set, bounds the context passed to each handler call.
+	JobTimeout time.Duration
+
+	// PopTimeout is the number of seconds each pop blocks before checking
+	// for shutdown.  One second is used when zero.
+	PopTimeout int
+
+	// ErrorHandler, if set, is called with the message and the error when a
+	// handler fails or panics, and with an empty message when a queue
+	// operation fails.
+	ErrorHandler func(message string, err error)
+
+	// quit, cancel and wg belong to the current run, so that a run left
+	// behind by a timed-out Shutdown does not share them with the next.
+	mu     sync.Mutex
+	quit   chan struct{}
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+}
+
+// NewWorker creates a Worker that runs the handler on the given number of
+// goroutines once started.
+func NewWorker(queue stringQueue, handler Handler, concurrency int) *Worker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Worker{queue: queue, handler: handler, concurrency: concurrency}
+}
+
+// Start begins fetching and handling messages.  Calling Start on a running
+// worker has no effect.  A worker may be started again once Shutdown has
+// returned, even if it timed out and handlers of the earlier run are still
+// returning.
+func (w *Worker) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.quit != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, w.cancel = context.WithCancel(context.Background())
+	w.quit = make(chan struct{})
+	w.wg = &sync.WaitGroup{}
+
+	for i := 0; i < w.concurrency; i++ {
+		w.wg.Add(1)
+		go w.fetch(ctx, w.quit, w.wg)
+	}
+}
+
+// Shutdown stops fetching new messages and waits for in-flight handlers to
+// return.  If the context is done first, the contexts passed to the
+// handlers are cancelled and the context's error is returned.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.quit == nil {
+		return nil
+	}
+	close(w.quit)
+	wg, cancel := w.wg, w.cancel
+	w.quit, w.cancel, w.wg = nil, nil, nil
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	defer cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Worker) fetch(ctx context.Context, quit chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	timeout := w.PopTimeout
+	if timeout == 0 {
+		timeout = 1
+	}
+	reliable, _ := w.queue.(reliableQueue)
+	if w.Consumer == "" {
+		reliable = nil
+	}
+
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		var err error
+		if reliable != nil {
+			var d *Delivery
+			if d, err = reliable.ReliablePop(w.Consumer, timeout); err == nil {
+				w.settle(d, w.handle(ctx, d.Value))
+			}
+		} else {
+			var message string
+			if message, err = w.queue.Pop(timeout); err == nil {
+				w.handle(ctx, message)
+			}
+		}
+
+		if err != nil && !errors.Is(err, ErrTimeout) {
+			w.reportError("", err)
+			select {
+			case <-quit:
+				return
+			case <-time.After(workerErrorBackoff):
+			}
+		}
+	}
+}
+
+// handle runs the handler for a message, recovering from panics.
+func (w *Worker) handle(ctx context.Context, message string) (err error) {
+	if w.JobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.JobTimeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Handler panicked: %v", r)
+		}
+		if err != nil {
+			w.reportError(message, err)
+		}
+	}()
+	return w.handler(ctx, message)
+}
+
+func (w *Worker) settle(d *Delivery, err error) {
+	if err == nil {
+		err = d.Ack()
+	} else {
+		err = d.NackWithError(true, err)
+	}
+	if err != nil {
+		w.reportError(d.Value, err)
+	}
+}
+
+func (w *Worker) reportError(message string, err error) {
+	if w.ErrorHandler != nil {
+		w.ErrorHandler(message, err)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rq provides a simple queue abstraction that is backed by Redis.
+package rq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// createWorkerPool creates a pool with enough connections for a worker's
+// goroutines and the test itself.
+func createWorkerPool() *redis.Pool {
+	return NewPool(testServer.Addr(), 5, 5, 240*time.Second)
+}
+
+// waitFor polls until the condition holds or a second has passed.
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestWorkerHandlesMessages(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_worker")
+	q := QueueConnect(pool, "rq_test_worker")
+
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[message] = true
+		return nil
+	}, 3)
+	w.Start()
+
+	q.PushBatch([]string{"a", "b", "c", "d", "e"})
+	if !waitFor(func() bool { mu.Lock(); defer mu.Unlock(); return len(handled) == 5 }) {
+		t.Error("Expected 5 messages handled, got: ", handled)
+	}
+
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestWorkerHandlesPriorityQueueMessages(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	q := NewPriorityQueue(pool, "rq_test_worker_priority", 2)
+	resetPriorityQueue(q)
+
+	handled := make(chan string, 2)
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		handled <- message
+		return nil
+	}, 1)
+	q.Push("bulk")
+	q.PushPriority("urgent", 0)
+	w.Start()
+
+	for _, expected := range []string{"urgent", "bulk"} {
+		select {
+		case message := <-handled:
+			if message != expected {
+				t.Errorf("Expected %s but got: %s", expected, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected a message to be handled")
+		}
+	}
+
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestWorkerReportsErrorsAndPanics(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_worker_errors")
+	q := QueueConnect(pool, "rq_test_worker_errors")
+
+	var mu sync.Mutex
+	failures := map[string]error{}
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		if message == "panic" {
+			panic("boom")
+		}
+		return errors.New("failed " + message)
+	}, 1)
+	w.ErrorHandler = func(message string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures[message] = err
+	}
+	w.Start()
+	defer w.Shutdown(context.Background())
+
+	q.PushBatch([]string{"panic", "error"})
+	if !waitFor(func() bool { mu.Lock(); defer mu.Unlock(); return len(failures) == 2 }) {
+		t.Fatal("Expected 2 failures, got: ", failures)
+	}
+	if failures["panic"] == nil || failures["error"].Error() != "failed error" {
+		t.Error("Unexpected failures: ", failures)
+	}
+}
+
+func TestWorkerReliableNacksFailedMessages(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	q := QueueConnect(pool, "rq_test_worker_reliable")
+	q.MaxAttempts = 3
+	resetDeadLetterQueue(q, "worker")
+
+	var mu sync.Mutex
+	attempts := 0
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errors.New("transcode failed")
+	}, 1)
+	w.Consumer = "worker"
+	w.Start()
+
+	q.Push("foo")
+	if !waitFor(func() bool { l, _ := q.DeadLength(); return l == 1 }) {
+		t.Fatal("Expected message to be dead-lettered")
+	}
+	w.Shutdown(context.Background())
+
+	if attempts != 3 {
+		t.Error("Expected 3 attempts, got: ", attempts)
+	}
+	letters, _ := q.DeadLetters(0, 0)
+	if len(letters) != 1 || letters[0].Error != "transcode failed" {
+		t.Errorf("Unexpected dead letters: %+v", letters)
+	}
+	if l := listLength(pool, q.processingKey("worker")); l != 0 {
+		t.Error("Expected empty processing list, was: ", l)
+	}
+}
+
+func TestWorkerShutdownWaitsForHandlers(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_worker_shutdown")
+	q := QueueConnect(pool, "rq_test_worker_shutdown")
+
+	started := make(chan struct{})
+	finished := false
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		finished = true
+		return nil
+	}, 1)
+	w.Start()
+
+	q.Push("foo")
+	<-started
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if !finished {
+		t.Error("Expected shutdown to wait for the in-flight handler")
+	}
+}
+
+func TestWorkerShutdownDeadlineCancelsHandlers(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_worker_shutdown_deadline")
+	q := QueueConnect(pool, "rq_test_worker_shutdown_deadline")
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}, 1)
+	w.Start()
+
+	q.Push("foo")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected deadline exceeded error, got: ", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the handler context to be cancelled")
+	}
+}
+
+func TestWorkerRestartAfterShutdownTimeout(t *testing.T) {
+	pool := createWorkerPool()
+	defer pool.Close()
+	deleteKey(pool, "rq_test_worker_restart")
+	q := QueueConnect(pool, "rq_test_worker_restart")
+
+	release := make(chan struct{})
+	handled := make(chan string, 2)
+	w := NewWorker(q, func(ctx context.Context, message string) error {
+		handled <- message
+		if message == "stuck" {
+			<-release
+		}
+		return nil
+	}, 1)
+	w.Start()
+
+	q.Push("stuck")
+	<-handled
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected deadline exceeded error, got: ", err)
+	}
+
+	w.Start()
+	q.Push("foo")
+	select {
+	case message := <-handled:
+		if message != "foo" {
+			t.Error("Expected foo but got: ", message)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the restarted worker to handle a message")
+	}
+
+	close(release)
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
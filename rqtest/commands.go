@@ -0,0 +1,1050 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// request is a single command being executed against a database.
+type request struct {
+	server   *Server
+	client   *client
+	db       *database
+	args     []string
+	modified bool
+}
+
+// command describes a supported command.  A positive arity is the exact
+// number of arguments including the command name, a negative arity the
+// minimum.  Blocking commands implement blocking instead of run, reporting
+// whether they could be served immediately.
+type command struct {
+	arity    int
+	run      func(r *request) interface{}
+	blocking func(r *request) (interface{}, bool)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":     {arity: -1, run: ping},
+		"ECHO":     {arity: 2, run: echo},
+		"AUTH":     {arity: -2, run: auth},
+		"QUIT":     {arity: 1, run: okCommand},
+		"SELECT":   {arity: 2, run: selectDB},
+		"ROLE":     {arity: 1, run: role},
+		"FLUSHDB":  {arity: 1, run: flushdb},
+		"FLUSHALL": {arity: 1, run: flushall},
+		"DBSIZE":   {arity: 1, run: dbsize},
+		"MULTI":    {arity: 1},
+		"EXEC":     {arity: 1},
+		"DISCARD":  {arity: 1},
+		"WATCH":    {arity: -2},
+		"UNWATCH":  {arity: 1},
+
+		"DEL":     {arity: -2, run: del},
+		"EXISTS":  {arity: -2, run: exists},
+		"TYPE":    {arity: 2, run: typeOf},
+		"KEYS":    {arity: 2, run: keys},
+		"EXPIRE":  {arity: 3, run: expire},
+		"PEXPIRE": {arity: 3, run: expire},
+		"TTL":     {arity: 2, run: ttl},
+		"GET":     {arity: 2, run: get},
+		"SET":     {arity: -3, run: set},
+		"INCR":    {arity: 2, run: incr},
+
+		"LPUSH":      {arity: -3, run: lpush},
+		"RPUSH":      {arity: -3, run: rpush},
+		"LPOP":       {arity: -2, run: lpop},
+		"RPOP":       {arity: -2, run: rpop},
+		"LLEN":       {arity: 2, run: llen},
+		"LRANGE":     {arity: 4, run: lrange},
+		"LINDEX":     {arity: 3, run: lindex},
+		"LREM":       {arity: 4, run: lrem},
+		"RPOPLPUSH":  {arity: 3, run: rpoplpush},
+		"BLPOP":      {arity: -3, blocking: blpop},
+		"BRPOP":      {arity: -3, blocking: brpop},
+		"BRPOPLPUSH": {arity: 4, blocking: brpoplpush},
+
+		"HSET":    {arity: -4, run: hset},
+		"HGET":    {arity: 3, run: hget},
+		"HDEL":    {arity: -3, run: hdel},
+		"HLEN":    {arity: 2, run: hlen},
+		"HGETALL": {arity: 2, run: hgetall},
+		"HINCRBY": {arity: 4, run: hincrby},
+
+		"SADD":      {arity: -3, run: sadd},
+		"SREM":      {arity: -3, run: srem},
+		"SCARD":     {arity: 2, run: scard},
+		"SISMEMBER": {arity: 3, run: sismember},
+		"SMEMBERS":  {arity: 2, run: smembers},
+
+		"ZADD":             {arity: -4, run: zadd},
+		"ZREM":             {arity: -3, run: zrem},
+		"ZCARD":            {arity: 2, run: zcard},
+		"ZSCORE":           {arity: 3, run: zscore},
+		"ZINCRBY":          {arity: 4, run: zincrby},
+		"ZRANGE":           {arity: -4, run: zrange},
+		"ZRANGEBYSCORE":    {arity: -4, run: zrangebyscore},
+		"ZREMRANGEBYSCORE": {arity: 4, run: zremrangebyscore},
+	}
+}
+
+var (
+	wrongTypeError = errorReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+	syntaxError    = errorReply("ERR syntax error")
+	notIntError    = errorReply("ERR value is not an integer or out of range")
+	notFloatError  = errorReply("ERR value is not a valid float")
+)
+
+// lookup returns the value stored at key, or an error reply if it holds a
+// different kind of value.  A nil value is returned for missing keys.
+func (r *request) lookup(key string, kind string) (*value, interface{}) {
+	v := r.db.get(key)
+	if v != nil && v.kind != kind {
+		return nil, wrongTypeError
+	}
+	return v, nil
+}
+
+// touch records that key was modified by the request.
+func (r *request) touch(key string) {
+	r.db.touch(key)
+	r.db.removeIfEmpty(key)
+	r.modified = true
+}
+
+// auth authenticates the client as the default user given only a password,
+// or as the named user.  A user without a password accepts any, as with
+// Redis' nopass.
+func auth(r *request) interface{} {
+	var username, password string
+	switch len(r.args) {
+	case 2:
+		if r.server.password == "" {
+			return errorReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+		username, password = "default", r.args[1]
+	case 3:
+		username, password = r.args[1], r.args[2]
+	default:
+		return errorReply("ERR syntax error")
+	}
+
+	expected, ok := r.server.users[username]
+	if username == "default" {
+		expected, ok = r.server.password, true
+	}
+	if !ok || expected != "" && password != expected {
+		return errorReply("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	r.client.authed = true
+	return statusReply("OK")
+}
+
+func okCommand(r *request) interface{} {
+	return statusReply("OK")
+}
+
+func ping(r *request) interface{} {
+	if len(r.args) > 1 {
+		return r.args[1]
+	}
+	return statusReply("PONG")
+}
+
+func echo(r *request) interface{} {
+	return r.args[1]
+}
+
+func selectDB(r *request) interface{} {
+	index, err := strconv.Atoi(r.args[1])
+	if err != nil || index < 0 || index > 15 {
+		return errorReply("ERR DB index is out of range")
+	}
+	r.client.db = index
+	return statusReply("OK")
+}
+
+func role(r *request) interface{} {
+	return []interface{}{"master", int64(0), []interface{}{}}
+}
+
+func flushdb(r *request) interface{} {
+	for key := range r.db.keys {
+		r.db.remove(key)
+	}
+	r.modified = true
+	return statusReply("OK")
+}
+
+func flushall(r *request) interface{} {
+	for _, db := range r.server.dbs {
+		for key := range db.keys {
+			db.remove(key)
+		}
+	}
+	r.modified = true
+	return statusReply("OK")
+}
+
+func dbsize(r *request) interface{} {
+	n := 0
+	for key := range r.db.keys {
+		if r.db.get(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func del(r *request) interface{} {
+	n := 0
+	for _, key := range r.args[1:] {
+		if r.db.get(key) != nil && r.db.remove(key) {
+			r.modified = true
+			n++
+		}
+	}
+	return n
+}
+
+func exists(r *request) interface{} {
+	n := 0
+	for _, key := range r.args[1:] {
+		if r.db.get(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func typeOf(r *request) interface{} {
+	v := r.db.get(r.args[1])
+	if v == nil {
+		return statusReply("none")
+	}
+	return statusReply(v.kind)
+}
+
+func keys(r *request) interface{} {
+	matched := []string{}
+	for key := range r.db.keys {
+		if ok, _ := path.Match(r.args[1], key); ok && r.db.get(key) != nil {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+func expire(r *request) interface{} {
+	n, err := strconv.ParseInt(r.args[2], 10, 64)
+	if err != nil {
+		return notIntError
+	}
+	v := r.db.get(r.args[1])
+	if v == nil {
+		return 0
+	}
+	unit := time.Second
+	if strings.ToUpper(r.args[0]) == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+	v.expireAt = time.Now().Add(time.Duration(n) * unit)
+	r.touch(r.args[1])
+	return 1
+}
+
+func ttl(r *request) interface{} {
+	v := r.db.get(r.args[1])
+	if v == nil {
+		return -2
+	}
+	if v.expireAt.IsZero() {
+		return -1
+	}
+	return int64(math.Ceil(v.expireAt.Sub(time.Now()).Seconds()))
+}
+
+func get(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], stringType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return nilBulk{}
+	}
+	return v.str
+}
+
+func set(r *request) interface{} {
+	key := r.args[1]
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(r.args); i++ {
+		switch strings.ToUpper(r.args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(r.args) {
+				return syntaxError
+			}
+			n, err := strconv.ParseInt(r.args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return errorReply("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if strings.ToUpper(r.args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return syntaxError
+		}
+	}
+
+	existing := r.db.get(key)
+	if nx && existing != nil || xx && existing == nil {
+		return nilBulk{}
+	}
+	v := &value{kind: stringType, str: r.args[2]}
+	if ttl > 0 {
+		v.expireAt = time.Now().Add(ttl)
+	}
+	r.db.keys[key] = v
+	r.touch(key)
+	return statusReply("OK")
+}
+
+func incr(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], stringType)
+	if errReply != nil {
+		return errReply
+	}
+	var n int64
+	if v != nil {
+		var err error
+		if n, err = strconv.ParseInt(v.str, 10, 64); err != nil {
+			return notIntError
+		}
+	} else {
+		v = r.db.create(r.args[1], stringType)
+	}
+	n++
+	v.str = strconv.FormatInt(n, 10)
+	r.touch(r.args[1])
+	return n
+}
+
+func push(r *request, left bool) interface{} {
+	key := r.args[1]
+	if _, errReply := r.lookup(key, listType); errReply != nil {
+		return errReply
+	}
+	v := r.db.create(key, listType)
+	for _, element := range r.args[2:] {
+		if left {
+			v.list = append([]string{element}, v.list...)
+		} else {
+			v.list = append(v.list, element)
+		}
+	}
+	r.touch(key)
+	return len(v.list)
+}
+
+func lpush(r *request) interface{} {
+	return push(r, true)
+}
+
+func rpush(r *request) interface{} {
+	return push(r, false)
+}
+
+// popList removes up to count elements from the left or right of a list.
+func (r *request) popList(key string, left bool, count int) ([]string, interface{}) {
+	v, errReply := r.lookup(key, listType)
+	if errReply != nil || v == nil {
+		return nil, errReply
+	}
+	if count > len(v.list) {
+		count = len(v.list)
+	}
+	popped := make([]string, count)
+	for i := range popped {
+		if left {
+			popped[i] = v.list[0]
+			v.list = v.list[1:]
+		} else {
+			popped[i] = v.list[len(v.list)-1]
+			v.list = v.list[:len(v.list)-1]
+		}
+	}
+	r.touch(key)
+	return popped, nil
+}
+
+func pop(r *request, left bool) interface{} {
+	count := 1
+	if len(r.args) > 3 {
+		return syntaxError
+	}
+	if len(r.args) == 3 {
+		var err error
+		if count, err = strconv.Atoi(r.args[2]); err != nil || count < 0 {
+			return notIntError
+		}
+	}
+	popped, errReply := r.popList(r.args[1], left, count)
+	if errReply != nil {
+		return errReply
+	}
+	if len(r.args) == 3 {
+		if popped == nil {
+			return nilArray{}
+		}
+		return popped
+	}
+	if len(popped) == 0 {
+		return nilBulk{}
+	}
+	return popped[0]
+}
+
+func lpop(r *request) interface{} {
+	return pop(r, true)
+}
+
+func rpop(r *request) interface{} {
+	return pop(r, false)
+}
+
+func llen(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], listType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.list)
+}
+
+// normalizeRange converts Redis style inclusive start and stop indexes,
+// which may be negative, into slice bounds for a sequence of length n.
+func normalizeRange(start, stop, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+func lrange(r *request) interface{} {
+	start, err1 := strconv.Atoi(r.args[2])
+	stop, err2 := strconv.Atoi(r.args[3])
+	if err1 != nil || err2 != nil {
+		return notIntError
+	}
+	v, errReply := r.lookup(r.args[1], listType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return []string{}
+	}
+	from, to := normalizeRange(start, stop, len(v.list))
+	return append([]string{}, v.list[from:to]...)
+}
+
+func lindex(r *request) interface{} {
+	index, err := strconv.Atoi(r.args[2])
+	if err != nil {
+		return notIntError
+	}
+	v, errReply := r.lookup(r.args[1], listType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return nilBulk{}
+	}
+	if index < 0 {
+		index += len(v.list)
+	}
+	if index < 0 || index >= len(v.list) {
+		return nilBulk{}
+	}
+	return v.list[index]
+}
+
+func lrem(r *request) interface{} {
+	count, err := strconv.Atoi(r.args[2])
+	if err != nil {
+		return notIntError
+	}
+	v, errReply := r.lookup(r.args[1], listType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+
+	element := r.args[3]
+	removed := 0
+	if count >= 0 {
+		kept := v.list[:0:0]
+		for _, e := range v.list {
+			if e == element && (count == 0 || removed < count) {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		v.list = kept
+	} else {
+		kept := make([]string, 0, len(v.list))
+		for i := len(v.list) - 1; i >= 0; i-- {
+			if v.list[i] == element && removed < -count {
+				removed++
+				continue
+			}
+			kept = append([]string{v.list[i]}, kept...)
+		}
+		v.list = kept
+	}
+	if removed > 0 {
+		r.touch(r.args[1])
+	}
+	return removed
+}
+
+func rpoplpush(r *request) interface{} {
+	reply, _ := brpoplpush(r)
+	return reply
+}
+
+// popFirst pops from the first non-empty list among keys.
+func popFirst(r *request, keys []string, left bool) (interface{}, bool) {
+	for _, key := range keys {
+		popped, errReply := r.popList(key, left, 1)
+		if errReply != nil {
+			return errReply, true
+		}
+		if len(popped) > 0 {
+			return []string{key, popped[0]}, true
+		}
+	}
+	return nil, false
+}
+
+func blpop(r *request) (interface{}, bool) {
+	return popFirst(r, r.args[1:len(r.args)-1], true)
+}
+
+func brpop(r *request) (interface{}, bool) {
+	return popFirst(r, r.args[1:len(r.args)-1], false)
+}
+
+func brpoplpush(r *request) (interface{}, bool) {
+	source, destination := r.args[1], r.args[2]
+	if _, errReply := r.lookup(destination, listType); errReply != nil {
+		return errReply, true
+	}
+	popped, errReply := r.popList(source, false, 1)
+	if errReply != nil {
+		return errReply, true
+	}
+	if len(popped) == 0 {
+		return nilBulk{}, false
+	}
+	v := r.db.create(destination, listType)
+	v.list = append([]string{popped[0]}, v.list...)
+	r.touch(destination)
+	return popped[0], true
+}
+
+func hset(r *request) interface{} {
+	if len(r.args)%2 != 0 {
+		return errorReply("ERR wrong number of arguments for 'hset' command")
+	}
+	key := r.args[1]
+	if _, errReply := r.lookup(key, hashType); errReply != nil {
+		return errReply
+	}
+	v := r.db.create(key, hashType)
+	added := 0
+	for i := 2; i < len(r.args); i += 2 {
+		if _, ok := v.hash[r.args[i]]; !ok {
+			added++
+		}
+		v.hash[r.args[i]] = r.args[i+1]
+	}
+	r.touch(key)
+	return added
+}
+
+func hget(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], hashType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return nilBulk{}
+	}
+	field, ok := v.hash[r.args[2]]
+	if !ok {
+		return nilBulk{}
+	}
+	return field
+}
+
+func hdel(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], hashType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	removed := 0
+	for _, field := range r.args[2:] {
+		if _, ok := v.hash[field]; ok {
+			delete(v.hash, field)
+			removed++
+		}
+	}
+	if removed > 0 {
+		r.touch(r.args[1])
+	}
+	return removed
+}
+
+func hlen(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], hashType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.hash)
+}
+
+func hgetall(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], hashType)
+	if errReply != nil {
+		return errReply
+	}
+	reply := []string{}
+	if v != nil {
+		for field, value := range v.hash {
+			reply = append(reply, field, value)
+		}
+	}
+	return reply
+}
+
+func hincrby(r *request) interface{} {
+	increment, err := strconv.ParseInt(r.args[3], 10, 64)
+	if err != nil {
+		return notIntError
+	}
+	key := r.args[1]
+	if _, errReply := r.lookup(key, hashType); errReply != nil {
+		return errReply
+	}
+	v := r.db.create(key, hashType)
+	var n int64
+	if field, ok := v.hash[r.args[2]]; ok {
+		if n, err = strconv.ParseInt(field, 10, 64); err != nil {
+			return errorReply("ERR hash value is not an integer")
+		}
+	}
+	n += increment
+	v.hash[r.args[2]] = strconv.FormatInt(n, 10)
+	r.touch(key)
+	return n
+}
+
+func sadd(r *request) interface{} {
+	key := r.args[1]
+	if _, errReply := r.lookup(key, setType); errReply != nil {
+		return errReply
+	}
+	v := r.db.create(key, setType)
+	added := 0
+	for _, member := range r.args[2:] {
+		if _, ok := v.set[member]; !ok {
+			v.set[member] = struct{}{}
+			added++
+		}
+	}
+	r.touch(key)
+	return added
+}
+
+func srem(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], setType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	removed := 0
+	for _, member := range r.args[2:] {
+		if _, ok := v.set[member]; ok {
+			delete(v.set, member)
+			removed++
+		}
+	}
+	if removed > 0 {
+		r.touch(r.args[1])
+	}
+	return removed
+}
+
+func scard(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], setType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.set)
+}
+
+func sismember(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], setType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	if _, ok := v.set[r.args[2]]; ok {
+		return 1
+	}
+	return 0
+}
+
+func smembers(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], setType)
+	if errReply != nil {
+		return errReply
+	}
+	members := []string{}
+	if v != nil {
+		for member := range v.set {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func parseScore(s string) (float64, bool) {
+	switch strings.ToLower(s) {
+	case "+inf", "inf":
+		return math.Inf(1), true
+	case "-inf":
+		return math.Inf(-1), true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func zadd(r *request) interface{} {
+	key := r.args[1]
+	var nx, xx, ch bool
+	i := 2
+options:
+	for ; i < len(r.args); i++ {
+		switch strings.ToUpper(r.args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+	}
+	pairs := r.args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 || nx && xx {
+		return syntaxError
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		var ok bool
+		if scores[j], ok = parseScore(pairs[2*j]); !ok {
+			return notFloatError
+		}
+	}
+
+	if _, errReply := r.lookup(key, zsetType); errReply != nil {
+		return errReply
+	}
+	v := r.db.create(key, zsetType)
+	changed := 0
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		old, exists := v.zset[member]
+		if exists && nx || !exists && xx {
+			continue
+		}
+		if !exists || ch && old != score {
+			changed++
+		}
+		v.zset[member] = score
+	}
+	r.touch(key)
+	return changed
+}
+
+func zrem(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], zsetType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	removed := 0
+	for _, member := range r.args[2:] {
+		if _, ok := v.zset[member]; ok {
+			delete(v.zset, member)
+			removed++
+		}
+	}
+	if removed > 0 {
+		r.touch(r.args[1])
+	}
+	return removed
+}
+
+func zcard(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], zsetType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.zset)
+}
+
+func zscore(r *request) interface{} {
+	v, errReply := r.lookup(r.args[1], zsetType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return nilBulk{}
+	}
+	score, ok := v.zset[r.args[2]]
+	if !ok {
+		return nilBulk{}
+	}
+	return formatScore(score)
+}
+
+func zincrby(r *request) interface{} {
+	increment, ok := parseScore(r.args[2])
+	if !ok {
+		return notFloatError
+	}
+	key := r.args[1]
+	if _, errReply := r.lookup(key, zsetType); errReply != nil {
+		return errReply
+	}
+	v := r.db.create(key, zsetType)
+	v.zset[r.args[3]] += increment
+	r.touch(key)
+	return formatScore(v.zset[r.args[3]])
+}
+
+func scoredReply(members []scoredMember, withScores bool) []string {
+	reply := []string{}
+	for _, m := range members {
+		reply = append(reply, m.member)
+		if withScores {
+			reply = append(reply, formatScore(m.score))
+		}
+	}
+	return reply
+}
+
+func zrange(r *request) interface{} {
+	start, err1 := strconv.Atoi(r.args[2])
+	stop, err2 := strconv.Atoi(r.args[3])
+	if err1 != nil || err2 != nil {
+		return notIntError
+	}
+	withScores := false
+	for _, arg := range r.args[4:] {
+		if strings.ToUpper(arg) != "WITHSCORES" {
+			return syntaxError
+		}
+		withScores = true
+	}
+	v, errReply := r.lookup(r.args[1], zsetType)
+	if errReply != nil {
+		return errReply
+	}
+	if v == nil {
+		return []string{}
+	}
+	members := v.sortedMembers()
+	from, to := normalizeRange(start, stop, len(members))
+	return scoredReply(members[from:to], withScores)
+}
+
+// scoreBound is one end of a score range, as accepted by ZRANGEBYSCORE.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseScoreBound(s string) (scoreBound, bool) {
+	b := scoreBound{}
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	var ok bool
+	b.value, ok = parseScore(s)
+	return b, ok
+}
+
+func (b scoreBound) below(score float64) bool {
+	if b.exclusive {
+		return b.value < score
+	}
+	return b.value <= score
+}
+
+func (b scoreBound) above(score float64) bool {
+	if b.exclusive {
+		return b.value > score
+	}
+	return b.value >= score
+}
+
+// membersByScore returns the members of the sorted set at key with scores
+// between the bounds given in args[2] and args[3].
+func (r *request) membersByScore() (*value, []scoredMember, interface{}) {
+	min, ok1 := parseScoreBound(r.args[2])
+	max, ok2 := parseScoreBound(r.args[3])
+	if !ok1 || !ok2 {
+		return nil, nil, errorReply("ERR min or max is not a float")
+	}
+	v, errReply := r.lookup(r.args[1], zsetType)
+	if errReply != nil || v == nil {
+		return nil, nil, errReply
+	}
+	var members []scoredMember
+	for _, m := range v.sortedMembers() {
+		if min.below(m.score) && max.above(m.score) {
+			members = append(members, m)
+		}
+	}
+	return v, members, nil
+}
+
+func zrangebyscore(r *request) interface{} {
+	withScores := false
+	offset, count := 0, -1
+	for i := 4; i < len(r.args); i++ {
+		switch strings.ToUpper(r.args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(r.args) {
+				return syntaxError
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(r.args[i+1])
+			count, err2 = strconv.Atoi(r.args[i+2])
+			if err1 != nil || err2 != nil {
+				return notIntError
+			}
+			i += 2
+		default:
+			return syntaxError
+		}
+	}
+
+	_, members, errReply := r.membersByScore()
+	if errReply != nil {
+		return errReply
+	}
+	if offset < 0 || offset >= len(members) {
+		return []string{}
+	}
+	members = members[offset:]
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+	return scoredReply(members, withScores)
+}
+
+func zremrangebyscore(r *request) interface{} {
+	v, members, errReply := r.membersByScore()
+	if errReply != nil {
+		return errReply
+	}
+	for _, m := range members {
+		delete(v.zset, m.member)
+	}
+	if len(members) > 0 {
+		r.touch(r.args[1])
+	}
+	return len(members)
+}
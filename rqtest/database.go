@@ -0,0 +1,145 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	stringType = "string"
+	listType   = "list"
+	hashType   = "hash"
+	setType    = "set"
+	zsetType   = "zset"
+)
+
+// value is a single key in a database.  Only the field matching kind is
+// used.
+type value struct {
+	kind     string
+	str      string
+	list     []string
+	hash     map[string]string
+	set      map[string]struct{}
+	zset     map[string]float64
+	expireAt time.Time
+}
+
+type database struct {
+	keys     map[string]*value
+	versions map[string]uint64
+}
+
+func newDatabase() *database {
+	return &database{keys: map[string]*value{}, versions: map[string]uint64{}}
+}
+
+// get returns the value stored at key, removing it first if it has expired.
+func (db *database) get(key string) *value {
+	v, ok := db.keys[key]
+	if !ok {
+		return nil
+	}
+	if !v.expireAt.IsZero() && !time.Now().Before(v.expireAt) {
+		db.remove(key)
+		return nil
+	}
+	return v
+}
+
+// create returns the value stored at key, creating an empty value of the
+// given kind if the key does not exist.
+func (db *database) create(key string, kind string) *value {
+	if v := db.get(key); v != nil {
+		return v
+	}
+	v := &value{kind: kind}
+	switch kind {
+	case hashType:
+		v.hash = map[string]string{}
+	case setType:
+		v.set = map[string]struct{}{}
+	case zsetType:
+		v.zset = map[string]float64{}
+	}
+	db.keys[key] = v
+	return v
+}
+
+func (db *database) remove(key string) bool {
+	if _, ok := db.keys[key]; !ok {
+		return false
+	}
+	delete(db.keys, key)
+	db.touch(key)
+	return true
+}
+
+// touch records a modification of key, invalidating transactions watching it.
+func (db *database) touch(key string) {
+	db.versions[key]++
+}
+
+func (db *database) version(key string) uint64 {
+	db.get(key)
+	return db.versions[key]
+}
+
+// removeIfEmpty deletes container values that no longer hold any elements,
+// as Redis does.
+func (db *database) removeIfEmpty(key string) {
+	v, ok := db.keys[key]
+	if !ok {
+		return
+	}
+	empty := false
+	switch v.kind {
+	case listType:
+		empty = len(v.list) == 0
+	case hashType:
+		empty = len(v.hash) == 0
+	case setType:
+		empty = len(v.set) == 0
+	case zsetType:
+		empty = len(v.zset) == 0
+	}
+	if empty {
+		delete(db.keys, key)
+	}
+}
+
+type scoredMember struct {
+	member string
+	score  float64
+}
+
+// sortedMembers returns the members of a sorted set ordered by score, then
+// lexicographically.
+func (v *value) sortedMembers() []scoredMember {
+	members := make([]scoredMember, 0, len(v.zset))
+	for member, score := range v.zset {
+		members = append(members, scoredMember{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
@@ -0,0 +1,268 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFailure is the error reply returned for a failed command when no
+// message is given.
+const DefaultFailure = "ERR injected failure"
+
+// Proxy relays connections to a Redis server, real or fake, and can be told
+// to inject faults: dropping connections, adding latency, black-holing
+// traffic and failing commands.  Commands are relayed one at a time and
+// each is answered before the next is read, so pipelines work but
+// publish/subscribe does not.
+type Proxy struct {
+	target   string
+	listener net.Listener
+
+	mu        sync.Mutex
+	conns     map[*proxyConn]struct{}
+	down      bool
+	latency   time.Duration
+	blackhole bool
+	failures  map[string]string
+	closed    bool
+
+	wg sync.WaitGroup
+}
+
+// proxyConn is a client connection and the connection relaying it to the
+// server.
+type proxyConn struct {
+	client net.Conn
+	server net.Conn
+}
+
+func (pc *proxyConn) close() {
+	pc.client.Close()
+	pc.server.Close()
+}
+
+// NewProxy starts a Proxy to the server at the target address, listening on
+// a random port of the loopback interface.
+func NewProxy(target string) (*Proxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		target:   target,
+		listener: listener,
+		conns:    map[*proxyConn]struct{}{},
+		failures: map[string]string{},
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Addr returns the host:port the proxy is listening on, suitable for
+// passing to rq.NewPool.
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Close stops the proxy and disconnects all clients.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.dropLocked()
+	p.mu.Unlock()
+
+	err := p.listener.Close()
+	p.wg.Wait()
+	return err
+}
+
+// DropConnections closes every open connection.  New connections are
+// relayed as usual.
+func (p *Proxy) DropConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropLocked()
+}
+
+func (p *Proxy) dropLocked() {
+	for pc := range p.conns {
+		pc.close()
+	}
+}
+
+// SetDown makes the proxy behave as if the server had stopped: while down,
+// open connections are closed and new connections are closed as soon as
+// they are accepted.
+func (p *Proxy) SetDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.down = down
+	if down {
+		p.dropLocked()
+	}
+}
+
+// SetLatency delays every command by the given duration before relaying it.
+func (p *Proxy) SetLatency(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latency = latency
+}
+
+// SetBlackhole makes the proxy swallow commands without relaying or
+// answering them, so clients wait until their read timeout.  A connection
+// that has had a command swallowed stays silent until it is closed.
+func (p *Proxy) SetBlackhole(blackhole bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.blackhole = blackhole
+}
+
+// FailCommand answers every command with the given name with an error
+// reply instead of relaying it.  DefaultFailure is used when the message is
+// empty.
+func (p *Proxy) FailCommand(name string, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if message == "" {
+		message = DefaultFailure
+	}
+	p.failures[strings.ToUpper(name)] = message
+}
+
+// Reset removes every injected fault.  Connections that have been
+// black-holed stay silent.
+func (p *Proxy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.down = false
+	p.latency = 0
+	p.blackhole = false
+	p.failures = map[string]string{}
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		down := p.closed || p.down
+		p.mu.Unlock()
+		if down {
+			c.Close()
+			continue
+		}
+
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		pc := &proxyConn{client: c, server: server}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			pc.close()
+			continue
+		}
+		p.conns[pc] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go p.relay(pc)
+	}
+}
+
+// fault returns the faults to inject into the named command.
+func (p *Proxy) fault(name string) (latency time.Duration, blackhole bool, failure string, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failure, failed = p.failures[strings.ToUpper(name)]
+	return p.latency, p.blackhole, failure, failed
+}
+
+func (p *Proxy) relay(pc *proxyConn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, pc)
+		p.mu.Unlock()
+		pc.close()
+	}()
+
+	r, w := bufio.NewReader(pc.client), bufio.NewWriter(pc.client)
+	serverR, serverW := bufio.NewReader(pc.server), bufio.NewWriter(pc.server)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		latency, blackhole, failure, failed := p.fault(args[0])
+		if blackhole {
+			io.Copy(io.Discard, r)
+			return
+		}
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+
+		var reply interface{}
+		if failed {
+			reply = errorReply(failure)
+		} else {
+			writeCommand(serverW, args)
+			if err = serverW.Flush(); err != nil {
+				return
+			}
+			if reply, err = readReply(serverR); err != nil {
+				return
+			}
+		}
+		writeReply(w, reply)
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func startProxy(t *testing.T) *Proxy {
+	p, err := NewProxy(startServer(t).Addr())
+	if err != nil {
+		t.Fatal("Unable to start proxy: ", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func dialProxy(t *testing.T, p *Proxy) redis.Conn {
+	c, err := redis.DialTimeout("tcp", p.Addr(), time.Second, 200*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal("Unable to connect: ", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestProxyRelays(t *testing.T) {
+	c := dialProxy(t, startProxy(t))
+	c.Send("LPUSH", "queue", "foo", "bar")
+	c.Send("MULTI")
+	c.Send("RPOP", "queue")
+	c.Send("GET", "missing")
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil || len(replies) != 2 || string(replies[0].([]byte)) != "foo" || replies[1] != nil {
+		t.Error("Unexpected replies: ", replies, err)
+	}
+}
+
+func TestProxyFailCommand(t *testing.T) {
+	p := startProxy(t)
+	c := dialProxy(t, p)
+
+	p.FailCommand("lpush", "")
+	if _, err := c.Do("LPUSH", "queue", "foo"); err == nil || err.Error() != DefaultFailure {
+		t.Error("Expected the injected failure, got: ", err)
+	}
+	if _, err := c.Do("PING"); err != nil {
+		t.Error("Expected other commands to be relayed, got: ", err)
+	}
+
+	p.Reset()
+	if _, err := c.Do("LPUSH", "queue", "foo"); err != nil {
+		t.Error("Expected the command to be relayed after a reset, got: ", err)
+	}
+}
+
+func TestProxyLatency(t *testing.T) {
+	p := startProxy(t)
+	c := dialProxy(t, p)
+
+	p.SetLatency(100 * time.Millisecond)
+	start := time.Now()
+	if _, err := c.Do("PING"); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Expected the command to be delayed, took: ", elapsed)
+	}
+}
+
+func TestProxyBlackhole(t *testing.T) {
+	p := startProxy(t)
+	c := dialProxy(t, p)
+
+	p.SetBlackhole(true)
+	if _, err := c.Do("PING"); err == nil {
+		t.Error("Expected the command to time out")
+	}
+
+	p.Reset()
+	if _, err := dialProxy(t, p).Do("PING"); err != nil {
+		t.Error("Expected new connections to be relayed, got: ", err)
+	}
+}
+
+func TestProxyDown(t *testing.T) {
+	p := startProxy(t)
+	c := dialProxy(t, p)
+
+	p.SetDown(true)
+	if _, err := c.Do("PING"); err == nil {
+		t.Error("Expected the open connection to be dropped")
+	}
+	if _, err := dialProxy(t, p).Do("PING"); err == nil {
+		t.Error("Expected new connections to be dropped")
+	}
+
+	p.SetDown(false)
+	if _, err := dialProxy(t, p).Do("PING"); err != nil {
+		t.Error("Expected the proxy to recover, got: ", err)
+	}
+}
+
+func TestProxyDropConnections(t *testing.T) {
+	p := startProxy(t)
+	c := dialProxy(t, p)
+	c.Do("PING")
+
+	p.DropConnections()
+	if _, err := c.Do("PING"); err == nil {
+		t.Error("Expected the open connection to be dropped")
+	}
+	if _, err := dialProxy(t, p).Do("PING"); err != nil {
+		t.Error("Expected new connections to be relayed, got: ", err)
+	}
+}
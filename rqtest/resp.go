@@ -0,0 +1,177 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type statusReply string
+
+type errorReply string
+
+type nilBulk struct{}
+
+type nilArray struct{}
+
+var protocolError = errors.New("Protocol error")
+
+// readLine reads a CRLF terminated line, without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", protocolError
+	}
+	return line[:len(line)-2], nil
+}
+
+// readCommand reads a command sent by a client, either as a RESP array of
+// bulk strings or as an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, protocolError
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, protocolError
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readReply reads a single reply sent by a server.  Status replies are
+// returned as statusReply, errors as errorReply, integers as int64, bulk
+// strings as string and arrays as []interface{}.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, protocolError
+	}
+
+	switch line[0] {
+	case '+':
+		return statusReply(line[1:]), nil
+	case '-':
+		return errorReply(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, protocolError
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, protocolError
+		}
+		if size < 0 {
+			return nilBulk{}, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, protocolError
+		}
+		if n < 0 {
+			return nilArray{}, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, protocolError
+}
+
+// writeCommand writes a command as a RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+}
+
+// writeReply writes a reply in RESP format.
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case statusReply:
+		w.WriteString("+" + string(reply) + "\r\n")
+	case errorReply:
+		w.WriteString("-" + string(reply) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(reply) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(reply, 10) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(reply)) + "\r\n" + reply + "\r\n")
+	case nilBulk:
+		w.WriteString("$-1\r\n")
+	case nilArray:
+		w.WriteString("*-1\r\n")
+	case []string:
+		w.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		for _, s := range reply {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		for _, r := range reply {
+			writeReply(w, r)
+		}
+	default:
+		w.WriteString("-ERR unsupported reply\r\n")
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-memory Redis server that speaks the RESP protocol.  It
+// implements the subset of commands used by the rq package: strings, lists
+// and blocking pops, hashes, sets, sorted sets, key expiry, AUTH, SELECT and
+// MULTI/EXEC transactions with WATCH.  It is intended for hermetic tests.
+type Server struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	dbs     map[int]*database
+	changed chan struct{}
+	conns   map[net.Conn]struct{}
+	closed  bool
+
+	// password is the default user's password, and users the passwords of
+	// the other ACL users.
+	password string
+	users    map[string]string
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a Server listening on a random port of the loopback
+// interface.
+func NewServer() (*Server, error) {
+	return NewServerAddr("127.0.0.1:0")
+}
+
+// NewServerAddr starts a Server listening on the given address.
+func NewServerAddr(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		dbs:      map[int]*database{},
+		changed:  make(chan struct{}),
+		conns:    map[net.Conn]struct{}{},
+		users:    map[string]string{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server is listening on, suitable for
+// passing to rq.NewPool.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and disconnects all clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.notify()
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// RequirePass sets the default user's password, like Redis' requirepass.
+// Clients must then authenticate with AUTH before running other commands.
+func (s *Server) RequirePass(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.password = password
+}
+
+// AddUser adds an ACL user that clients may authenticate as with AUTH
+// username password.  An empty password accepts any.
+func (s *Server) AddUser(username string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[username] = password
+}
+
+// Clients returns the number of connected clients.  A client is counted
+// until any command it was blocked on has returned.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// FlushAll removes every key from every database.
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, db := range s.dbs {
+		for key := range db.keys {
+			db.remove(key)
+		}
+	}
+	s.notify()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// notify wakes every client blocked on a pop.  It must be called with the
+// server lock held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) db(index int) *database {
+	db, ok := s.dbs[index]
+	if !ok {
+		db = newDatabase()
+		s.dbs[index] = db
+	}
+	return db
+}
+
+// client holds the per-connection state of a Redis client.
+type client struct {
+	db      int
+	authed  bool
+	multi   bool
+	queued  [][]string
+	dirty   bool
+	watched map[watchKey]uint64
+	done    chan struct{}
+}
+
+type watchKey struct {
+	db  int
+	key string
+}
+
+// authenticated reports whether the client may run commands, which it may
+// until a password is required of the default user.
+func (s *Server) authenticated(cl *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return cl.authed || s.password == ""
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	cl := &client{watched: map[watchKey]uint64{}, done: make(chan struct{})}
+	pending := make(chan []string, 64)
+	go func() {
+		defer close(cl.done)
+		defer close(pending)
+		r := bufio.NewReader(c)
+		for {
+			args, err := readCommand(r)
+			if err != nil {
+				return
+			}
+			if len(args) > 0 {
+				pending <- args
+			}
+		}
+	}()
+
+	w := bufio.NewWriter(c)
+	for args := range pending {
+		reply := s.execute(cl, args)
+		writeReply(w, reply)
+		if len(pending) == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			w.Flush()
+			return
+		}
+	}
+}
+
+func (s *Server) execute(cl *client, args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		if cl.multi {
+			cl.dirty = true
+		}
+		return errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		if cl.multi {
+			cl.dirty = true
+		}
+		return errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+	if name != "AUTH" && name != "QUIT" && !s.authenticated(cl) {
+		if cl.multi {
+			cl.dirty = true
+		}
+		return errorReply("NOAUTH Authentication required.")
+	}
+
+	switch name {
+	case "MULTI":
+		if cl.multi {
+			return errorReply("ERR MULTI calls can not be nested")
+		}
+		cl.multi = true
+		return statusReply("OK")
+	case "DISCARD":
+		if !cl.multi {
+			return errorReply("ERR DISCARD without MULTI")
+		}
+		cl.resetTransaction()
+		return statusReply("OK")
+	case "EXEC":
+		if !cl.multi {
+			return errorReply("ERR EXEC without MULTI")
+		}
+		return s.exec(cl)
+	case "WATCH":
+		if cl.multi {
+			return errorReply("ERR WATCH inside MULTI is not allowed")
+		}
+		s.mu.Lock()
+		for _, key := range args[1:] {
+			cl.watched[watchKey{cl.db, key}] = s.db(cl.db).version(key)
+		}
+		s.mu.Unlock()
+		return statusReply("OK")
+	case "UNWATCH":
+		cl.watched = map[watchKey]uint64{}
+		return statusReply("OK")
+	}
+
+	if cl.multi {
+		cl.queued = append(cl.queued, args)
+		return statusReply("QUEUED")
+	}
+
+	if cmd.blocking != nil {
+		return s.block(cl, args, cmd)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run(cl, args, cmd)
+}
+
+func (s *Server) exec(cl *client) interface{} {
+	defer cl.resetTransaction()
+
+	if cl.dirty {
+		return errorReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for wk, version := range cl.watched {
+		if s.db(wk.db).version(wk.key) != version {
+			return nilArray{}
+		}
+	}
+
+	replies := make([]interface{}, len(cl.queued))
+	for i, args := range cl.queued {
+		replies[i] = s.run(cl, args, commands[strings.ToUpper(args[0])])
+	}
+	return replies
+}
+
+func (cl *client) resetTransaction() {
+	cl.multi = false
+	cl.dirty = false
+	cl.queued = nil
+	cl.watched = map[watchKey]uint64{}
+}
+
+// run executes a command with the server lock held.  Blocking commands are
+// run without blocking, as they are inside a transaction.
+func (s *Server) run(cl *client, args []string, cmd command) interface{} {
+	if s.closed {
+		return errorReply("ERR server closed")
+	}
+	req := &request{server: s, client: cl, db: s.db(cl.db), args: args}
+	var reply interface{}
+	if cmd.blocking != nil {
+		var ok bool
+		if reply, ok = cmd.blocking(req); !ok {
+			reply = nilArray{}
+		}
+	} else {
+		reply = cmd.run(req)
+	}
+	if req.modified {
+		s.notify()
+	}
+	return reply
+}
+
+// block runs a blocking command, waiting until it can be served, its
+// timeout expires or the client disconnects.
+func (s *Server) block(cl *client, args []string, cmd command) interface{} {
+	seconds, err := strconv.ParseFloat(args[len(args)-1], 64)
+	if err != nil || seconds < 0 {
+		return errorReply("ERR timeout is not a float or out of range")
+	}
+	var expired <-chan time.Time
+	if seconds > 0 {
+		timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-cl.done:
+			return nilArray{}
+		default:
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return errorReply("ERR server closed")
+		}
+		req := &request{server: s, client: cl, db: s.db(cl.db), args: args}
+		reply, ok := cmd.blocking(req)
+		if req.modified {
+			s.notify()
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if ok {
+			return reply
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return nilArray{}
+		case <-cl.done:
+			return nilArray{}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2014 Brighcove Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rqtest provides test helpers for code that uses Redis queues.
+package rqtest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func startServer(t *testing.T) *Server {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal("Unable to start server: ", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dial(t *testing.T, s *Server) redis.Conn {
+	c, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal("Unable to connect: ", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServerPing(t *testing.T) {
+	c := dial(t, startServer(t))
+	if reply, err := redis.String(c.Do("PING")); reply != "PONG" || err != nil {
+		t.Error("Expected PONG but got: ", reply, err)
+	}
+	if _, err := c.Do("NOSUCHCOMMAND"); err == nil {
+		t.Error("Expected an unknown command error")
+	}
+}
+
+func TestServerLists(t *testing.T) {
+	c := dial(t, startServer(t))
+	c.Do("LPUSH", "queue", "a", "b", "c")
+	if l, err := redis.Int(c.Do("LLEN", "queue")); l != 3 || err != nil {
+		t.Error("Expected length 3 but got: ", l, err)
+	}
+	if values, err := redis.Strings(c.Do("LRANGE", "queue", 0, -1)); len(values) != 3 || values[0] != "c" || err != nil {
+		t.Error("Unexpected range: ", values, err)
+	}
+	if value, err := redis.String(c.Do("RPOP", "queue")); value != "a" || err != nil {
+		t.Error("Expected a but got: ", value, err)
+	}
+	if _, err := c.Do("ZADD", "queue", 1, "x"); err == nil {
+		t.Error("Expected a wrong type error")
+	}
+}
+
+func TestServerBlockingPop(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s)
+
+	start := time.Now()
+	if _, err := redis.Strings(c.Do("BRPOP", "queue", 1)); err != redis.ErrNil {
+		t.Error("Expected a timeout but got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Error("Expected to wait for the timeout, took: ", elapsed)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pusher, err := redis.Dial("tcp", s.Addr())
+		if err != nil {
+			return
+		}
+		defer pusher.Close()
+		pusher.Do("LPUSH", "queue", "foo")
+	}()
+	if reply, err := redis.Strings(c.Do("BRPOP", "queue", 0)); err != nil || reply[1] != "foo" {
+		t.Error("Expected the push to wake the pop, got: ", reply, err)
+	}
+}
+
+func TestServerClients(t *testing.T) {
+	s := startServer(t)
+	c, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal("Unable to connect: ", err)
+	}
+	c.Do("PING")
+	if n := s.Clients(); n != 1 {
+		t.Error("Expected 1 client, got: ", n)
+	}
+
+	c.Send("BLPOP", "list", 0)
+	c.Flush()
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for s.Clients() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := s.Clients(); n != 0 {
+		t.Error("Expected the blocked client to be released, got: ", n)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s)
+	if _, err := c.Do("AUTH", "secret"); err == nil {
+		t.Error("Expected AUTH without a configured password to fail")
+	}
+
+	s.RequirePass("secret")
+	s.AddUser("app", "apppass")
+	c = dial(t, s)
+	if _, err := c.Do("PING"); err == nil || err.Error() != "NOAUTH Authentication required." {
+		t.Error("Expected NOAUTH error, got: ", err)
+	}
+	for _, args := range [][]interface{}{{"wrong"}, {"app", "secret"}, {"nobody", "apppass"}, {"default", "apppass"}} {
+		if _, err := c.Do("AUTH", args...); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+			t.Error("Expected WRONGPASS error for ", args, ", got: ", err)
+		}
+	}
+	if _, err := c.Do("PING"); err == nil {
+		t.Error("Expected commands to fail after bad credentials")
+	}
+
+	for _, args := range [][]interface{}{{"secret"}, {"default", "secret"}, {"app", "apppass"}} {
+		c = dial(t, s)
+		if reply, err := redis.String(c.Do("AUTH", args...)); reply != "OK" || err != nil {
+			t.Error("Expected OK for ", args, ", got: ", reply, err)
+		}
+		if reply, err := redis.String(c.Do("PING")); reply != "PONG" || err != nil {
+			t.Error("Expected PONG but got: ", reply, err)
+		}
+	}
+}
+
+func TestServerSortedSets(t *testing.T) {
+	c := dial(t, startServer(t))
+	c.Do("ZADD", "delayed", 3, "c", 1, "a", 2, "b")
+	if members, err := redis.Strings(c.Do("ZRANGEBYSCORE", "delayed", "-inf", 2)); len(members) != 2 || members[0] != "a" || err != nil {
+		t.Error("Unexpected members: ", members, err)
+	}
+	if n, err := redis.Int(c.Do("ZREM", "delayed", "a")); n != 1 || err != nil {
+		t.Error("Expected one removal but got: ", n, err)
+	}
+	if n, err := redis.Int(c.Do("ZCARD", "delayed")); n != 2 || err != nil {
+		t.Error("Expected 2 members but got: ", n, err)
+	}
+}
+
+func TestServerSelect(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s)
+	c.Do("LPUSH", "queue", "foo")
+	if _, err := c.Do("SELECT", 2); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if l, _ := redis.Int(c.Do("LLEN", "queue")); l != 0 {
+		t.Error("Expected databases to be separate, length was: ", l)
+	}
+	if _, err := c.Do("SELECT", 16); err == nil {
+		t.Error("Expected an out of range database to be rejected")
+	}
+
+	s.FlushAll()
+	c.Do("SELECT", 0)
+	if l, _ := redis.Int(c.Do("LLEN", "queue")); l != 0 {
+		t.Error("Expected FlushAll to empty the server, length was: ", l)
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s)
+	other := dial(t, s)
+
+	c.Do("WATCH", "queue")
+	other.Do("LPUSH", "queue", "foo")
+	c.Send("MULTI")
+	c.Send("LPUSH", "queue", "bar")
+	if reply, err := c.Do("EXEC"); reply != nil || err != nil {
+		t.Error("Expected the transaction to abort, got: ", reply, err)
+	}
+
+	c.Send("MULTI")
+	c.Send("LPUSH", "queue", "bar")
+	if replies, err := redis.Values(c.Do("EXEC")); len(replies) != 1 || err != nil {
+		t.Error("Expected the transaction to run, got: ", replies, err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Do("BRPOP", "queue", 0)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected the blocked client to be disconnected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to disconnect blocked clients")
+	}
+	if _, err := redis.Dial("tcp", s.Addr()); err == nil {
+		t.Error("Expected the server to stop listening")
+	}
+}